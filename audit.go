@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// Operations recorded in the audit log
+const (
+	auditOpen = "open"
+	auditRead = "read"
+	auditStat = "stat" // a Getattr that decrypted to size a file
+	auditHTTP = "http" // GET /v1/secrets
+	auditGet  = "get"
+	auditExec = "exec"
+)
+
+// auditGenesis is the prev hash of the first record of a new audit log
+var auditGenesis = strings.Repeat("0", sha256.Size*2)
+
+// auditRotatedLayout names rotated files: audit.jsonl.20261016T050346.123Z.
+// The fixed width keeps lexical order chronological.
+const auditRotatedLayout = "20060102T150405.000Z"
+
+// fuseContext returns the uid, gid and pid of the process behind the current
+// FUSE operation, replaceable in tests
+var fuseContext = fuse.Getcontext
+
+// renameAuditFile renames the current file on rotation, replaceable in tests
+var renameAuditFile = os.Rename
+
+// auditCaller identifies who a record is for. IDs that are not known, such as
+// those of an HTTP client on a TCP port, are -1.
+type auditCaller struct {
+	uid, gid uint32
+	pid      int
+	remote   string // HTTP client address
+}
+
+var unknownCaller = auditCaller{uid: ^uint32(0), gid: ^uint32(0), pid: -1}
+
+// auditErrno is the errno recorded for err, 0 for success
+func auditErrno(err error) int {
+	if err == nil {
+		return 0
+	}
+	return errno(err)
+}
+
+// processCaller is this process, for get and exec
+func processCaller() auditCaller {
+	return auditCaller{uid: uint32(os.Getuid()), gid: uint32(os.Getgid()), pid: os.Getpid()}
+}
+
+// secretAccess is one secret read to serve a file, addressed as below the
+// mount point
+type secretAccess struct {
+	KeyPath string `json:"key_path"`
+	Cache   string `json:"cache"` // hit or miss
+}
+
+func newSecretAccess(path string, hit bool) secretAccess {
+	a := secretAccess{KeyPath: strings.TrimPrefix(path, "/"), Cache: "miss"}
+	if hit {
+		a.Cache = "hit"
+	}
+	return a
+}
+
+// auditRecord is one line of the audit log. Hash is the SHA-256 of the record
+// encoded without it, and Prev is the hash of the record before, so editing,
+// inserting or removing a record breaks the chain from there on.
+type auditRecord struct {
+	Seq     uint64         `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Op      string         `json:"op"`
+	Path    string         `json:"path"`
+	Secrets []secretAccess `json:"secrets,omitempty"`
+	PID     int            `json:"pid"`
+	UID     uint32         `json:"uid"`
+	GID     uint32         `json:"gid"`
+	Remote  string         `json:"remote,omitempty"`
+	Errno   int            `json:"errno,omitempty"` // negative errno returned to the caller
+	Prev    string         `json:"prev"`
+	Hash    string         `json:"hash,omitempty"`
+}
+
+func (r auditRecord) computeHash() string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditFlags are the audit log flags shared by the mount, get and exec
+type auditFlags struct {
+	file     string
+	rotateMB int
+	keep     int
+}
+
+func (f *auditFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "audit-log", "", "Append a hash-chained record of every secret read through the mount, HTTP API, get and exec to this file (disabled if empty)")
+	fs.IntVar(&f.rotateMB, "audit-rotate-size", 10, "Rotate the audit log when it would grow past this many MiB (0 never rotates)")
+	fs.IntVar(&f.keep, "audit-keep", 0, "Rotated audit logs to keep, deleting the oldest (0 keeps all)")
+}
+
+func (f *auditFlags) validate() error {
+	if f.rotateMB < 0 || f.keep < 0 {
+		return errors.New("invalid -audit-rotate-size or -audit-keep: must not be negative")
+	}
+	return nil
+}
+
+// open opens the audit log, or returns a nil trail without -audit-log
+func (f *auditFlags) open() (*auditTrail, error) {
+	if f.file == "" {
+		return nil, nil
+	}
+	return openAuditTrail(f.file, int64(f.rotateMB)<<20, f.keep)
+}
+
+// auditTrail appends hash-chained records to an audit log, separate from the
+// debug log, rotating it by size. A nil trail records nothing. The mount, get
+// and exec may share one log: each record is appended under a lock on
+// path.lock, after catching up with what other processes appended.
+type auditTrail struct {
+	mu         sync.Mutex
+	path       string
+	rotateSize int64
+	keep       int      // rotated files kept, 0 for all
+	lock       *os.File // held across processes while appending
+	f          *os.File // nil after a failed reopen, retried on the next record
+	closed     bool
+	size       int64
+	seq        uint64
+	prev       string
+}
+
+// openAuditTrail opens path for appending and continues the hash chain from
+// its last record, or from the newest rotated file if path is new
+func openAuditTrail(path string, rotateSize int64, keep int) (*auditTrail, error) {
+	a := &auditTrail{path: path, rotateSize: rotateSize, keep: keep}
+
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	defer unlockFile(lock)
+	a.lock = lock
+
+	if a.seq, a.prev, err = auditHead(path); err == nil {
+		err = a.openFile()
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	auditLog.Info("Audit log opened", "file", path, "seq", a.seq, "head", a.prev)
+	return a, nil
+}
+
+// auditHead returns the seq and hash of the last record in path or, if path
+// is new or empty, in the newest rotated file that has one
+func auditHead(path string) (uint64, string, error) {
+	files, err := auditFiles(path)
+	if err != nil {
+		return 0, "", err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, ok, err := lastAuditRecord(files[i])
+		if err != nil {
+			return 0, "", fmt.Errorf("audit log %s: %w; run win-secrets audit verify and move it aside", files[i], err)
+		}
+		if ok {
+			return last.Seq, last.Hash, nil
+		}
+	}
+	return 0, auditGenesis, nil
+}
+
+// syncLocked catches up with records another process appended, or a file it
+// rotated, since this one last wrote. Call with the lock file held.
+func (a *auditTrail) syncLocked() error {
+	fi, err := os.Stat(a.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if a.f != nil {
+		cur, cerr := a.f.Stat()
+		if err == nil && cerr == nil && os.SameFile(fi, cur) && fi.Size() == a.size {
+			return nil
+		}
+		if err != nil || cerr != nil || !os.SameFile(fi, cur) {
+			a.f.Close()
+			a.f = nil
+		}
+	}
+	if a.seq, a.prev, err = auditHead(a.path); err != nil {
+		return err
+	}
+	if a.f == nil {
+		return a.openFile()
+	}
+	a.size = fi.Size()
+	return nil
+}
+
+func (a *auditTrail) openFile() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.size = f, fi.Size()
+	return nil
+}
+
+// record appends one record for the FUSE operation in progress
+func (a *auditTrail) record(op, path string, secrets []secretAccess, errc int) error {
+	if a == nil {
+		return nil
+	}
+	uid, gid, pid := fuseContext()
+	return a.recordFor(auditCaller{uid: uid, gid: gid, pid: pid}, op, path, secrets, errc)
+}
+
+// recordFor appends one record for a read outside FUSE: the HTTP API, get or
+// exec
+func (a *auditTrail) recordFor(caller auditCaller, op, path string, secrets []secretAccess, errc int) error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return errors.New("audit log is closed")
+	}
+	if err := lockFile(a.lock); err != nil {
+		return err
+	}
+	defer unlockFile(a.lock)
+	if err := a.syncLocked(); err != nil {
+		return fmt.Errorf("read audit log: %w", err)
+	}
+
+	r := auditRecord{
+		Seq:     a.seq + 1,
+		Time:    time.Now().UTC(),
+		Op:      op,
+		Path:    path,
+		Secrets: secrets,
+		PID:     caller.pid,
+		UID:     caller.uid,
+		GID:     caller.gid,
+		Remote:  caller.remote,
+		Errno:   errc,
+		Prev:    a.prev,
+	}
+	r.Hash = r.computeHash()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if a.f != nil && a.rotateSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.rotateSize {
+		// A failed rotation must not stop the mount; keep appending instead
+		if err := a.rotateLocked(); err != nil {
+			auditLog.Warn("Cannot rotate audit log", "file", a.path, "error", err)
+		}
+	}
+	if a.f == nil {
+		if err := a.openFile(); err != nil {
+			return fmt.Errorf("reopen audit log: %w", err)
+		}
+	}
+	// One write per record, so a crash cannot interleave partial lines
+	n, err := a.f.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.seq, a.prev = r.Seq, r.Hash
+	return nil
+}
+
+// rotateLocked renames the current file with a timestamp suffix, starts a new
+// one and removes the oldest rotated files beyond keep. The chain carries on
+// into the new file. Whether or not the rename succeeds, a.path is reopened
+// afterwards; a.f is only left nil if that fails too.
+func (a *auditTrail) rotateLocked() error {
+	files, err := auditFiles(a.path)
+	if err != nil {
+		return err
+	}
+	// The current file is last, unless it was moved away outside the process
+	old := slices.DeleteFunc(files, func(f string) bool { return f == a.path })
+
+	// The new name must sort after every rotated file, even within the same
+	// millisecond or after the clock went back
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if len(old) > 0 {
+		newest, _ := time.Parse(auditRotatedLayout, strings.TrimPrefix(filepath.Base(old[len(old)-1]), filepath.Base(a.path)+"."))
+		if !now.After(newest) {
+			now = newest.Add(time.Millisecond)
+		}
+	}
+	rotated := a.path + "." + now.Format(auditRotatedLayout)
+
+	// Windows cannot rename a file that is still open
+	err = a.f.Close()
+	a.f = nil
+	if err == nil {
+		err = renameAuditFile(a.path, rotated)
+	}
+	if openErr := a.openFile(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	if err != nil {
+		return err
+	}
+	auditLog.Info("Audit log rotated", "file", rotated, "seq", a.seq, "head", a.prev)
+
+	old = append(old, rotated)
+	if a.keep <= 0 {
+		return nil
+	}
+	for len(old) > a.keep {
+		if err := os.Remove(old[0]); err != nil {
+			return err
+		}
+		auditLog.Info("Removed rotated audit log", "file", old[0])
+		old = old[1:]
+	}
+	return nil
+}
+
+// close closes the file and logs the head of the chain, which verify can be
+// checked against to detect truncation
+func (a *auditTrail) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	var err error
+	if a.f != nil {
+		err = a.f.Close()
+		a.f = nil
+	}
+	a.lock.Close()
+	auditLog.Info("Audit log closed", "file", a.path, "seq", a.seq, "head", a.prev)
+	return err
+}
+
+// auditFiles lists the rotated files of path oldest first, then path itself
+// if it exists
+func auditFiles(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), filepath.Base(path)+".")
+		if _, err := time.Parse(auditRotatedLayout, suffix); ok && err == nil {
+			files = append(files, filepath.Join(filepath.Dir(path), e.Name()))
+		}
+	}
+	slices.Sort(files)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// lastAuditRecord returns the last record of file, or false if it is empty
+func lastAuditRecord(file string) (auditRecord, bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return auditRecord{}, false, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return auditRecord{}, false, nil
+	}
+	last := data[bytes.LastIndexByte(data, '\n')+1:]
+	var r auditRecord
+	if err := json.Unmarshal(last, &r); err != nil || r.Hash != r.computeHash() {
+		return auditRecord{}, false, errors.New("last record is damaged")
+	}
+	return r, true, nil
+}
+
+// auditSummary is the result of verifying an audit log
+type auditSummary struct {
+	files   int
+	records int
+	first   uint64 // seq of the oldest record kept
+	head    string // hash of the newest record
+}
+
+// verifyAuditLog checks the hash chain across path and its rotated files. A
+// chain that does not start at seq 1 is accepted, since rotation may have
+// removed the oldest files, but every record after the first must follow on.
+func verifyAuditLog(path string) (auditSummary, error) {
+	files, err := auditFiles(path)
+	if err != nil {
+		return auditSummary{}, err
+	}
+	if len(files) == 0 {
+		return auditSummary{}, fmt.Errorf("%s: no audit log", path)
+	}
+
+	s := auditSummary{files: len(files)}
+	var seq uint64
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return s, err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		for line := 1; sc.Scan(); line++ {
+			var r auditRecord
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				f.Close()
+				return s, fmt.Errorf("%s:%d: not an audit record: %w", file, line, err)
+			}
+			switch {
+			case r.Hash != r.computeHash():
+				err = errors.New("record does not match its hash")
+			case s.records == 0 && r.Seq == 1 && r.Prev != auditGenesis:
+				err = errors.New("first record does not start the chain")
+			case s.records > 0 && r.Seq != seq+1:
+				err = fmt.Errorf("expected seq %d, got %d", seq+1, r.Seq)
+			case s.records > 0 && r.Prev != s.head:
+				err = errors.New("record does not follow the one before")
+			}
+			if err != nil {
+				f.Close()
+				return s, fmt.Errorf("%s:%d (seq %d): %w", file, line, r.Seq, err)
+			}
+			if s.records == 0 {
+				s.first = r.Seq
+			}
+			s.records++
+			seq, s.head = r.Seq, r.Hash
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return s, nil
+}
+
+// runAudit implements "win-secrets audit verify"
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintf(os.Stderr, "Usage: win-secrets audit verify [flags]\n")
+		return 2
+	}
+
+	var client clientFlags
+	flags := newSubcommandFlags("audit", &client)
+	path := flags.String("audit-log", "", "Audit log to verify, with its rotated files")
+	flags.Parse(args[1:])
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	if *path == "" {
+		cliLog.Error("No audit log: set -audit-log or audit.file in the config file")
+		return 2
+	}
+
+	s, err := verifyAuditLog(*path)
+	if err != nil {
+		cliLog.Error("Audit log verification failed", "error", err)
+		return 1
+	}
+	if s.records == 0 {
+		fmt.Printf("%s: OK (no records)\n", *path)
+		return 0
+	}
+	fmt.Printf("%s: OK (%d records in %d files, seq %d to %d, head %s)\n", *path, s.records, s.files, s.first, s.first+uint64(s.records)-1, s.head)
+	return 0
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// fakeFuseContext makes every audited operation come from one process
+func fakeFuseContext(t *testing.T, uid, gid uint32, pid int) {
+	t.Helper()
+	orig := fuseContext
+	fuseContext = func() (uint32, uint32, int) { return uid, gid, pid }
+	t.Cleanup(func() { fuseContext = orig })
+}
+
+func readAuditRecords(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []auditRecord
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var r auditRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatalf("Bad audit line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestAuditOpenAndRead(t *testing.T) {
+	fakeFuseContext(t, 1000, 100, 4242)
+	fs, _ := mountFixture(t, "prod", "postgres:\n  user: admin\n  pass: s3cret\napi:\n  token: t0k3n\n", cachePolicy{{glob: "prod/api/**", ttl: 0}})
+	fs.templatesDir = t.TempDir()
+	writeTestFile(t, fs.templatesDir, "pgpass", []byte(`{{ secret "postgres/user" }}:{{ secret "postgres/pass" }}`))
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	if fs.audit, err = openAuditTrail(auditPath, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	buff := make([]byte, 64)
+	fs.Open("/prod/postgres/pass", 0)
+	fs.Read("/prod/postgres/pass", buff, 0, 0)
+	fs.Read("/prod/postgres/pass", buff, 0, 0)
+	fs.Read("/prod/api/token", buff, 0, 0)
+	fs.Read("/templates/pgpass", buff, 0, 0)
+	fs.Open("/prod/nope", 0)
+	fs.Read("/prod/nope", buff, 0, 0)
+	if err := fs.audit.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAuditRecords(t, auditPath)
+	expected := []struct {
+		op      string
+		path    string
+		secrets []secretAccess
+		errno   int
+	}{
+		{op: auditOpen, path: "/prod/postgres/pass"},
+		{op: auditRead, path: "/prod/postgres/pass", secrets: []secretAccess{{"prod/postgres/pass", "miss"}}},
+		{op: auditRead, path: "/prod/postgres/pass", secrets: []secretAccess{{"prod/postgres/pass", "hit"}}},
+		{op: auditRead, path: "/prod/api/token", secrets: []secretAccess{{"prod/api/token", "miss"}}},
+		{op: auditRead, path: "/templates/pgpass", secrets: []secretAccess{{"prod/postgres/user", "miss"}, {"prod/postgres/pass", "hit"}}},
+		{op: auditOpen, path: "/prod/nope", errno: -2},
+		{op: auditRead, path: "/prod/nope", errno: -2},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for i, e := range expected {
+		r := records[i]
+		if r.Op != e.op || r.Path != e.path || !reflect.DeepEqual(r.Secrets, e.secrets) || r.Errno != e.errno {
+			t.Errorf("Record %d: expected %+v, got %+v", i, e, r)
+		}
+		if r.PID != 4242 || r.UID != 1000 || r.GID != 100 || r.Seq != uint64(i+1) || time.Since(r.Time) > time.Minute {
+			t.Errorf("Record %d: unexpected caller or sequence %+v", i, r)
+		}
+	}
+
+	data, _ := os.ReadFile(auditPath)
+	for _, plain := range []string{"s3cret", "t0k3n", "admin"} {
+		if bytes.Contains(data, []byte(plain)) {
+			t.Errorf("Audit log contains the value %q", plain)
+		}
+	}
+	if s, err := verifyAuditLog(auditPath); err != nil || s.records != len(expected) {
+		t.Errorf("Expected a valid chain of %d records, got %+v %v", len(expected), s, err)
+	}
+}
+
+// TestAuditOtherFrontends checks that reads outside FUSE Open and Read land
+// in the same chain: sizing a rendered document, the HTTP API, get and exec
+func TestAuditOtherFrontends(t *testing.T) {
+	fakeFuseContext(t, 1000, 100, 4242)
+	fs, _ := mountFixture(t, "prod", "postgres:\n  user: admin\n  pass: s3cret\n", cachePolicy{{glob: "**", ttl: 0}})
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	if fs.audit, err = openAuditTrail(auditPath, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/prod/postgres.env", &stat, 0); errc != 0 {
+		t.Fatalf("Getattr returned %d", errc)
+	}
+	// Sizing from the envelope reads no secret and is not recorded
+	fs.Getattr("/prod/postgres/user", &stat, 0)
+
+	srv := httptest.NewServer(newSecretsAPI(fs, "t0k3n"))
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/secrets/prod/postgres/pass", nil)
+	req.Header.Set("Authorization", "Bearer t0k3n")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, err := fs.secretEnv([]envMapping{{name: "PGUSER", ref: "postgres/user"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.audit.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAuditRecords(t, auditPath)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %+v", records)
+	}
+	unknown := ^uint32(0)
+	for i, e := range []auditRecord{
+		{Op: auditStat, Path: "/prod/postgres.env", Secrets: []secretAccess{{"prod/postgres.env", "miss"}}, PID: 4242, UID: 1000, GID: 100},
+		{Op: auditHTTP, Path: "/prod/postgres/pass", Secrets: []secretAccess{{"prod/postgres/pass", "miss"}}, PID: -1, UID: unknown, GID: unknown},
+		{Op: auditExec, Path: "/prod/postgres/user", Secrets: []secretAccess{{"prod/postgres/user", "miss"}}, PID: os.Getpid(), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())},
+	} {
+		r := records[i]
+		if r.Op != e.Op || r.Path != e.Path || !reflect.DeepEqual(r.Secrets, e.Secrets) || r.PID != e.PID || r.UID != e.UID || r.GID != e.GID {
+			t.Errorf("Record %d: expected %+v, got %+v", i, e, r)
+		}
+	}
+	if !strings.HasPrefix(records[1].Remote, "127.0.0.1:") || records[0].Remote != "" {
+		t.Errorf("Expected the HTTP client address on the HTTP record only, got %q and %q", records[1].Remote, records[0].Remote)
+	}
+	if s, err := verifyAuditLog(auditPath); err != nil || s.records != 3 {
+		t.Errorf("Expected a valid chain of 3 records, got %+v %v", s, err)
+	}
+}
+
+// TestAuditSharedLog checks that a mount and a get or exec appending to one
+// log keep a single chain
+func TestAuditSharedLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	mount, err := openAuditTrail(auditPath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mount.close()
+	for i := 0; i < 3; i++ {
+		cli, err := openAuditTrail(auditPath, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.recordFor(processCaller(), auditGet, "/prod/postgres/pass", nil, 0); err != nil {
+			t.Fatal(err)
+		}
+		cli.close()
+		if err := mount.record(auditRead, "/prod/postgres/pass", nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s, err := verifyAuditLog(auditPath); err != nil || s.records != 6 {
+		t.Errorf("Expected one valid chain of 6 records, got %+v %v", s, err)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	write := func(n int) {
+		t.Helper()
+		a, err := openAuditTrail(auditPath, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := a.record(auditRead, "/prod/postgres/pass", nil, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a.close()
+	}
+
+	// A restart continues the chain
+	write(3)
+	write(2)
+	records := readAuditRecords(t, auditPath)
+	if records[0].Prev != auditGenesis || records[3].Seq != 4 || records[3].Prev != records[2].Hash {
+		t.Fatalf("Expected one chain across restarts, got %+v", records)
+	}
+	s, err := verifyAuditLog(auditPath)
+	if err != nil || s.records != 5 || s.first != 1 || s.head != records[4].Hash {
+		t.Fatalf("Expected 5 valid records, got %+v %v", s, err)
+	}
+
+	original, _ := os.ReadFile(auditPath)
+	lines := strings.SplitAfter(string(original), "\n")
+	tamper := map[string]string{
+		"edited":    strings.Join(lines[:2], "") + strings.Replace(lines[2], `"pid":0`, `"pid":1`, 1) + strings.Join(lines[3:], ""),
+		"removed":   strings.Join(lines[:2], "") + strings.Join(lines[3:], ""),
+		"reordered": lines[0] + lines[2] + lines[1] + strings.Join(lines[3:], ""),
+		"truncated": strings.Join(lines[:4], "") + `{"seq":5`,
+	}
+	for name, content := range tamper {
+		if err := os.WriteFile(auditPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifyAuditLog(auditPath); err == nil {
+			t.Errorf("Expected the %s log to fail verification", name)
+		}
+	}
+
+	// A damaged tail stops the mount rather than starting a new chain
+	if err := os.WriteFile(auditPath, []byte(tamper["truncated"]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openAuditTrail(auditPath, 0, 0); err == nil {
+		t.Errorf("Expected a damaged audit log to be refused")
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	a, err := openAuditTrail(auditPath, 1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := a.record(auditOpen, "/prod/postgres/pass", nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.close()
+
+	files, err := auditFiles(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[2] != auditPath {
+		t.Fatalf("Expected two rotated files and the current one, got %q", files)
+	}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err != nil || fi.Size() > 1000 {
+			t.Errorf("Expected %s within the rotate size, got %v %v", f, fi.Size(), err)
+		}
+	}
+
+	s, err := verifyAuditLog(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.files != 3 || s.first == 1 || s.first+uint64(s.records)-1 != 30 {
+		t.Errorf("Expected the newest records through seq 30 with the oldest rotated away, got %+v", s)
+	}
+
+	// Removing a rotated file in the middle breaks the chain
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(auditPath); err == nil {
+		t.Errorf("Expected a missing rotated file to fail verification")
+	}
+}
+
+func TestAuditVerifyCommand(t *testing.T) {
+	isolateUserConfig(t)
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditTrail(auditPath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.record(auditOpen, "/prod/postgres/pass", nil, 0)
+	a.close()
+
+	out, code := captureStdout(t, func() int { return runAudit([]string{"verify", "-audit-log", auditPath}) })
+	if code != 0 || !strings.HasPrefix(out, auditPath+": OK (1 records in 1 files, seq 1 to 1, head ") {
+		t.Errorf("Expected the log to verify, got %d %q", code, out)
+	}
+	if code := runAudit([]string{"verify", "-audit-log", filepath.Join(t.TempDir(), "missing.jsonl")}); code != 1 {
+		t.Errorf("Expected exit 1 for a missing log, got %d", code)
+	}
+	if code := runAudit([]string{"check"}); code != 2 {
+		t.Errorf("Expected usage exit 2, got %d", code)
+	}
+}
+
+func TestAuditRotationFailure(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditTrail(auditPath, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	renameAuditFile = func(string, string) error { return errors.New("sharing violation") }
+	t.Cleanup(func() { renameAuditFile = os.Rename })
+	for i := 0; i < 20; i++ {
+		if err := a.record(auditOpen, "/prod/postgres/pass", nil, 0); err != nil {
+			t.Fatalf("Record %d: expected a failed rotation to keep recording, got %v", i+1, err)
+		}
+	}
+	if files, _ := auditFiles(auditPath); len(files) != 1 {
+		t.Fatalf("Expected no rotated files, got %q", files)
+	}
+
+	// The next rotation succeeds once the rename does
+	renameAuditFile = os.Rename
+	if err := a.record(auditOpen, "/prod/postgres/pass", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := auditFiles(auditPath); len(files) != 2 {
+		t.Errorf("Expected a rotated file and the current one, got %q", files)
+	}
+	if s, err := verifyAuditLog(auditPath); err != nil || s.records != 21 {
+		t.Errorf("Expected a valid chain of 21 records, got %+v %v", s, err)
+	}
+}
+
+func TestAuditLogMovedAway(t *testing.T) {
+	dir := t.TempDir()
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	moved := filepath.Join(dir, "moved.jsonl")
+	a, err := openAuditTrail(auditPath, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+
+	// Another process moves the log away just before it is rotated
+	renameAuditFile = func(from, to string) error {
+		if err := os.Rename(from, moved); err != nil {
+			return err
+		}
+		return os.Rename(from, to)
+	}
+	t.Cleanup(func() { renameAuditFile = os.Rename })
+	for i := 0; i < 20; i++ {
+		if err := a.record(auditOpen, "/prod/postgres/pass", nil, 0); err != nil {
+			t.Fatalf("Record %d: expected recording to carry on in a new file, got %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(moved); err != nil {
+		t.Fatalf("Expected the log to have been moved away: %v", err)
+	}
+	records := readAuditRecords(t, auditPath)
+	if len(records) == 0 || records[len(records)-1].Seq != 20 {
+		t.Errorf("Expected the newest records in a new file, got %+v", records)
+	}
+}
+
+func TestAuditLogMissingOnRotate(t *testing.T) {
+	dir := t.TempDir()
+	other, err := os.Create(filepath.Join(dir, "other.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The open handle no longer has a file at the audit path, as after the
+	// log was removed outside the process
+	lock, err := os.Create(filepath.Join(dir, "audit.jsonl.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditTrail{path: filepath.Join(dir, "audit.jsonl"), rotateSize: 10, lock: lock, f: other, size: 5, prev: auditGenesis}
+	defer a.close()
+
+	if err := a.record(auditOpen, "/prod/postgres/pass", nil, 0); err != nil {
+		t.Fatalf("Expected the record in a new file, got %v", err)
+	}
+	if records := readAuditRecords(t, a.path); len(records) != 1 || records[0].Seq != 1 {
+		t.Errorf("Expected one record in the new file, got %+v", records)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile blocks until this process holds the exclusive lock on f. Only a
+// byte far past the end is locked, since Windows locks are mandatory.
+func lockFile(f *os.File) error {
+	ol := windows.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, &ol)
+}
+
+func unlockFile(f *os.File) error {
+	ol := windows.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// minCleanupPeriod keeps a policy with very short TTLs from spinning the
+// cleanup loop
+const minCleanupPeriod = time.Second
+
+// cacheRule gives the decrypted values whose path matches glob their own TTL;
+// a zero TTL means the value is never cached
+type cacheRule struct {
+	glob string
+	ttl  time.Duration
+}
+
+// cachePolicy is the ordered list of -cache-ttl rules. The first rule matching
+// a value's path wins; values no rule matches use secretCacheTTL.
+type cachePolicy []cacheRule
+
+// parseCacheRule parses glob=ttl. Globs match the path below the mount point
+// without file suffixes, e.g. prod/postgres/admin_pass: path.Match syntax per
+// element, plus ** for any number of elements.
+func parseCacheRule(v string) (cacheRule, error) {
+	glob, ttl, found := strings.Cut(v, "=")
+	if !found || glob == "" {
+		return cacheRule{}, fmt.Errorf("cache rule %q: want glob=ttl", v)
+	}
+	for _, elem := range strings.Split(glob, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return cacheRule{}, fmt.Errorf("cache rule %q: %w", v, err)
+		}
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return cacheRule{}, fmt.Errorf("cache rule %q: %w", v, err)
+	}
+	if d < 0 {
+		return cacheRule{}, fmt.Errorf("cache rule %q: negative TTL", v)
+	}
+	return cacheRule{glob: glob, ttl: d}, nil
+}
+
+func (p *cachePolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	parts := make([]string, len(*p))
+	for i, r := range *p {
+		parts[i] = r.glob + "=" + r.ttl.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *cachePolicy) Set(v string) error {
+	rule, err := parseCacheRule(v)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, rule)
+	return nil
+}
+
+// ttl returns how long the value at keyPath may stay cached
+func (p cachePolicy) ttl(keyPath string) time.Duration {
+	for _, r := range p {
+		if matchKeyGlob(r.glob, keyPath) {
+			return r.ttl
+		}
+	}
+	return secretCacheTTL
+}
+
+// subtreeTTL returns the TTL of a value rendering the whole node at keyPath:
+// the shortest TTL of the node itself and of every leaf below it, so a
+// document never outlives the most sensitive value it contains
+func (p cachePolicy) subtreeTTL(keyPath string, node interface{}) time.Duration {
+	ttl := p.ttl(keyPath)
+	leaves := make(map[string]interface{})
+	collectLeaves(node, "", leaves)
+	for leaf := range leaves {
+		if leaf != "" {
+			ttl = min(ttl, p.ttl(keyPath+"/"+leaf))
+		}
+	}
+	return ttl
+}
+
+// cleanupPeriod is how often the cache cleanup loop must run to evict entries
+// close to their TTL: the shortest positive TTL in use, capped at
+// cacheCleanupPeriod
+func (p cachePolicy) cleanupPeriod() time.Duration {
+	period := min(cacheCleanupPeriod, secretCacheTTL)
+	for _, r := range p {
+		if r.ttl > 0 {
+			period = min(period, r.ttl)
+		}
+	}
+	return max(period, minCleanupPeriod)
+}
+
+// matchKeyGlob matches a "/"-separated key path against a glob whose elements
+// use path.Match syntax, with a ** element matching zero or more elements
+func matchKeyGlob(pattern, keyPath string) bool {
+	return matchGlobElems(strings.Split(pattern, "/"), strings.Split(keyPath, "/"))
+}
+
+func matchGlobElems(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchGlobElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchKeyGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		keyPath string
+		match   bool
+	}{
+		{"secrets/postgres/admin_pass", "secrets/postgres/admin_pass", true},
+		{"secrets/postgres/*", "secrets/postgres/admin_pass", true},
+		{"secrets/postgres/*", "secrets/postgres/replicas/0", false},
+		{"secrets/*_pass", "secrets/wifi_pass", true},
+		{"prod/**", "prod/postgres/admin_pass", true},
+		{"prod/**", "prod", true},
+		{"**/token", "prod/api/token", true},
+		{"**/token", "token", true},
+		{"**/token", "prod/api/token2", false},
+		{"*/wifi/**", "home/wifi/office/psk", true},
+		{"prod/**", "dev/postgres", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchKeyGlob(tt.pattern, tt.keyPath); got != tt.match {
+			t.Errorf("matchKeyGlob(%q, %q) = %v, expected %v", tt.pattern, tt.keyPath, got, tt.match)
+		}
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	var p cachePolicy
+	for _, v := range []string{"prod/**/token=0", "prod/**=30s", "*/wifi/*=1h"} {
+		if err := p.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	for _, v := range []string{"prod/**", "=1m", "prod/[=1m", "prod/**=-1s", "prod/**=soon"} {
+		if err := p.Set(v); err == nil {
+			t.Errorf("Expected %q to be rejected", v)
+		}
+	}
+
+	ttls := map[string]time.Duration{
+		"prod/api/token":      0,
+		"prod/postgres/pass":  30 * time.Second,
+		"home/wifi/psk":       time.Hour,
+		"dev/postgres/pass":   secretCacheTTL,
+		"home/wifi/office/ps": secretCacheTTL,
+	}
+	for keyPath, expected := range ttls {
+		if got := p.ttl(keyPath); got != expected {
+			t.Errorf("ttl(%q) = %s, expected %s", keyPath, got, expected)
+		}
+	}
+
+	// A document is limited by the most sensitive value it renders
+	prod := map[string]interface{}{"postgres": map[string]interface{}{"pass": "x"}, "api": map[string]interface{}{"token": "y"}}
+	if got := p.subtreeTTL("prod", prod); got != 0 {
+		t.Errorf("Expected prod subtree TTL 0, got %s", got)
+	}
+	if got := p.subtreeTTL("home", map[string]interface{}{"wifi": map[string]interface{}{"psk": "z"}}); got != secretCacheTTL {
+		t.Errorf("Expected home subtree TTL %s, got %s", secretCacheTTL, got)
+	}
+
+	if got := p.cleanupPeriod(); got != 30*time.Second {
+		t.Errorf("Expected cleanup every 30s, got %s", got)
+	}
+	if got := (cachePolicy{}).cleanupPeriod(); got != secretCacheTTL {
+		t.Errorf("Expected default cleanup every %s, got %s", secretCacheTTL, got)
+	}
+	if got := (cachePolicy{{glob: "**", ttl: time.Millisecond}}).cleanupPeriod(); got != minCleanupPeriod {
+		t.Errorf("Expected cleanup period floor %s, got %s", minCleanupPeriod, got)
+	}
+}
+
+func TestReadSecretHonoursCachePolicy(t *testing.T) {
+	policy := cachePolicy{{glob: "secrets/api/*", ttl: 0}, {glob: "secrets/wifi", ttl: time.Hour}}
+	fs, ks := mountFixture(t, "secrets", "api:\n  token: t0k3n\nwifi: hunter2\n", policy)
+
+	for _, p := range []string{"/secrets/api/token", "/secrets/wifi", "/secrets/api.json", "/secrets/api/token"} {
+		if _, err := fs.readSecret(p); err != nil {
+			t.Fatalf("readSecret(%s): %v", p, err)
+		}
+	}
+
+	cache := fs.files["secrets"].cache
+	if _, ok := cache["/secrets/api/token"]; ok {
+		t.Errorf("Expected a TTL 0 secret not to be cached")
+	}
+	if _, ok := cache["/secrets/api.json"]; ok {
+		t.Errorf("Expected a document containing a TTL 0 secret not to be cached")
+	}
+	if cached, ok := cache["/secrets/wifi"]; !ok || cached.ttl != time.Hour {
+		t.Errorf("Expected wifi cached for 1h, got %+v", cached)
+	}
+
+	// The decrypted tree holds the token too, so it is not kept either and
+	// every read that misses the value cache unwraps the data key again
+	if ks.calls != 4 {
+		t.Errorf("Expected 4 data-key requests, got %d", ks.calls)
+	}
+	if _, err := fs.readSecret("/secrets/wifi"); err != nil || ks.calls != 4 {
+		t.Errorf("Expected the cached wifi value without a data-key request, calls=%d err=%v", ks.calls, err)
+	}
+}
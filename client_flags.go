@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// clientFlags are the flags every mode needs to load its config, reach the
+// key services and find the secrets files, registered on the main flag set
+// and on subcommands
+type clientFlags struct {
+	configPath     string
+	logFile        string
+	logLevel       string
+	logFormat      string
+	keyserviceAddr string
+	tls            keyserviceTLS
+	mode           string
+	secrets        secretsFlag
+	format         string
+}
+
+func (c *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "", "YAML config file supplying any flag not given on the command line (default win-secrets/config.yaml in the user config directory, if it exists)")
+	fs.StringVar(&c.logFile, "log-file", "", "Append logs to this file instead of stderr")
+	fs.StringVar(&c.logLevel, "log-level", "info", "Minimum level logged: debug, info, warn or error, optionally per subsystem (fs, sops, keyservice, cache, http, cli, audit) as in warn,fs=debug")
+	fs.StringVar(&c.logFormat, "log-format", "text", "Log record format: text or json")
+	fs.StringVar(&c.keyserviceAddr, "keyservice", "sops-keyservice.lan:5000", "Comma-separated SOPS keyservice addresses, tried healthiest first (host:port, tcp://host:port, unix:///path/to.sock or unix-abstract:name)")
+	fs.StringVar(&c.tls.caFile, "keyservice-ca", "", "PEM CA bundle to verify the keyservice certificate (enables TLS; default system roots)")
+	fs.StringVar(&c.tls.certFile, "keyservice-cert", "", "PEM client certificate for mutual TLS with the keyservice (enables TLS)")
+	fs.StringVar(&c.tls.keyFile, "keyservice-key", "", "PEM private key for -keyservice-cert")
+	fs.StringVar(&c.tls.serverName, "keyservice-server-name", "", "Server name to verify in the keyservice certificate (enables TLS; default host of -keyservice)")
+	fs.StringVar(&c.mode, "keyservice-mode", string(keyserviceRemote), "Key services allowed to unwrap data keys: remote (-keyservice only), local (this user's keys and credentials) or both")
+	fs.Var(&c.secrets, "secrets", "SOPS-encrypted file to mount, as name=path or a bare path mounted as \"secrets\", optionally followed by :format (repeatable, default secrets.yaml)")
+	fs.StringVar(&c.format, "format", "", "SOPS store format of the secrets files without a :format of their own: yaml, json, dotenv, ini or binary (default: by file extension)")
+}
+
+// validate checks the flags and fills in the default secrets file
+func (c *clientFlags) validate() (keyserviceMode, error) {
+	if len(c.secrets) == 0 {
+		c.secrets = secretsFlag{{name: defaultSecretsName, path: "secrets.yaml"}}
+	}
+	if err := validateStoreFormat(c.format); err != nil {
+		return "", fmt.Errorf("invalid -format: %w", err)
+	}
+	for i := range c.secrets {
+		if c.secrets[i].format == "" {
+			c.secrets[i].format = c.format
+		}
+	}
+
+	if c.tls.enabled() {
+		if _, err := c.tls.config(); err != nil {
+			return "", fmt.Errorf("invalid keyservice TLS settings: %w", err)
+		}
+	}
+
+	mode, err := parseKeyserviceMode(c.mode)
+	if err != nil {
+		return "", fmt.Errorf("invalid -keyservice-mode: %w", err)
+	}
+	return mode, nil
+}
+
+// newClient configures SOPS_KEYSERVICE and creates the SOPS client. Call
+// validate first.
+func (c *clientFlags) newClient() (*SopsClient, error) {
+	if err := configureSOPSKeyservice(c.keyserviceAddr); err != nil {
+		return nil, fmt.Errorf("failed to configure SOPS keyservice: %w", err)
+	}
+	sc, err := NewSopsClient(c.keyserviceAddr, c.tls, keyserviceMode(c.mode))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOPS client: %w", err)
+	}
+	return sc, nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// subcommand is a mode selected by the first argument. Without one,
+// win-secrets mounts the filesystem configured by its flags.
+type subcommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) int
+}
+
+// subcommands is filled in init: the commands refer back to it for usage
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{name: "get", usage: "[flags] <key/path>", summary: "Print one decrypted value", run: runGet},
+		{name: "ls", usage: "[flags] [key/path]", summary: "List keys without decrypting anything", run: runLs},
+		{name: "exec", usage: "[flags] -- command [args...]", summary: "Run a command with secrets in its environment", run: runExec},
+		{name: "selftest", usage: "[flags]", summary: "Decrypt one value from each secrets file and report which key service unwrapped it", run: runSelfTest},
+		{name: "probe", usage: "[flags]", summary: "Probe each keyservice (SOPS Decrypt with an invalid key, gRPC health) and print JSON results", run: runProbe},
+		{name: "audit", usage: "verify [flags]", summary: "Check the hash chain of the audit log and its rotated files", run: runAudit},
+		{name: "config", usage: "validate [flags]", summary: "Check the config file and the settings it produces without starting anything", run: runConfig},
+		{name: "version", summary: "Print version", run: runVersion},
+	}
+}
+
+func findSubcommand(name string) (subcommand, bool) {
+	for _, c := range subcommands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// newSubcommandFlags returns the flag set of a subcommand with the shared
+// keyservice and -secrets flags registered
+func newSubcommandFlags(cmd string, client *clientFlags) *flag.FlagSet {
+	c, _ := findSubcommand(cmd)
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	if client != nil {
+		client.register(flags)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: win-secrets %s %s\n\n%s.\n\n", c.name, c.usage, c.summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parseInterspersed parses flags before and after positional arguments, so
+// "get postgres/admin_pass -json" works like "get -json postgres/admin_pass"
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// openFS builds the filesystem without mounting it. Without connect no key
+// service is dialed, which is enough to list the structure.
+func (c *clientFlags) openFS(connect bool) (*SopsFS, error) {
+	if _, err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	sc := &SopsClient{}
+	if connect {
+		var err error
+		if sc, err = c.newClient(); err != nil {
+			return nil, err
+		}
+	}
+
+	fs, err := NewSopsFS(sc, c.secrets, sizeFromEnvelope, nil)
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// close wipes everything decrypted, disconnects from the key services and
+// closes the audit log
+func (fs *SopsFS) close() {
+	fs.wipeSecrets()
+	fs.sopsClient.Close()
+	fs.audit.close()
+}
+
+// openAudited is openFS for get and exec, with the audit log opened
+func (c *clientFlags) openAudited(audit *auditFlags) (*SopsFS, error) {
+	if err := audit.validate(); err != nil {
+		return nil, err
+	}
+	fs, err := c.openFS(true)
+	if err != nil {
+		return nil, err
+	}
+	if fs.audit, err = audit.open(); err != nil {
+		fs.close()
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	return fs, nil
+}
+
+func runGet(args []string) int {
+	var client clientFlags
+	flags := newSubcommandFlags("get", &client)
+	var audit auditFlags
+	audit.register(flags)
+	asJSON := flags.Bool("json", false, "Print {\"path\": ..., \"value\": ...} instead of the raw value; values that are not UTF-8 are base64 with \"encoding\": \"base64\"")
+	positional := parseInterspersed(flags, args)
+	if len(positional) != 1 {
+		flags.Usage()
+		return 2
+	}
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	fs, err := client.openAudited(&audit)
+	if err != nil {
+		cliLog.Error("Cannot open secrets", "error", err)
+		return 1
+	}
+	defer fs.close()
+
+	path := fs.secretRefPath(positional[0])
+	var out []byte
+	accessed, err := fs.withFile(path, func(data []byte) {
+		if !*asJSON {
+			out = append(out, data...)
+			return
+		}
+		value := map[string]string{"path": strings.TrimPrefix(path, "/"), "value": string(data)}
+		if !utf8.Valid(data) {
+			value["value"] = base64.StdEncoding.EncodeToString(data)
+			value["encoding"] = "base64"
+		}
+		out, _ = json.Marshal(value)
+		out = append(out, '\n')
+	})
+	defer clear(out)
+	if aerr := fs.audit.recordFor(processCaller(), auditGet, path, accessed, auditErrno(err)); aerr != nil {
+		cliLog.Error("Cannot write audit record", "path", positional[0], "error", aerr)
+		return 1
+	}
+	if err != nil {
+		if node, ok := fs.lookup(path); ok && node.isDir() {
+			err = fmt.Errorf("is a directory; get %s.yaml, .json or .env for the whole subtree", strings.TrimPrefix(path, "/"))
+		}
+		cliLog.Error("Cannot get secret", "path", positional[0], "error", err)
+		return 1
+	}
+
+	if _, err := os.Stdout.Write(out); err != nil {
+		cliLog.Error("Cannot write output", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func runLs(args []string) int {
+	var client clientFlags
+	flags := newSubcommandFlags("ls", &client)
+	recursive := flags.Bool("r", false, "List every value below the path, one key path per line")
+	asJSON := flags.Bool("json", false, "Print the structure as nested JSON objects with null leaves")
+	positional := parseInterspersed(flags, args)
+	if len(positional) > 1 {
+		flags.Usage()
+		return 2
+	}
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+
+	fs, err := client.openFS(false)
+	if err != nil {
+		cliLog.Error("Cannot open secrets", "error", err)
+		return 1
+	}
+	defer fs.close()
+
+	var prefix string
+	var node interface{}
+	if len(positional) == 0 {
+		root := make(map[string]interface{}, len(fs.fileNames))
+		for _, name := range fs.fileNames {
+			root[name] = fs.files[name].tree
+			if fs.files[name].binary {
+				root[name] = ""
+			}
+		}
+		node = root
+	} else {
+		path := fs.secretRefPath(positional[0])
+		n, ok := fs.lookup(path)
+		if !ok {
+			cliLog.Error("Not found", "path", positional[0])
+			return 1
+		}
+		prefix, node = strings.TrimPrefix(path, "/"), n.value
+	}
+
+	switch {
+	case *asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(treeListing(node)); err != nil {
+			cliLog.Error("Cannot write output", "error", err)
+			return 1
+		}
+	case !isDirNode(node):
+		fmt.Println(prefix)
+	case *recursive:
+		leaves := make(map[string]interface{})
+		collectLeaves(node, prefix, leaves)
+		keys := make([]string, 0, len(leaves))
+		for k := range leaves {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+	default:
+		var names []string
+		childEntries(node, func(name string, value interface{}) {
+			if isDirNode(value) {
+				name += "/"
+			}
+			names = append(names, name)
+		})
+		if _, ok := node.(map[string]interface{}); ok {
+			slices.Sort(names) // sequences are already in index order
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	}
+	return 0
+}
+
+func runSelfTest(args []string) int {
+	var client clientFlags
+	flags := newSubcommandFlags("selftest", &client)
+	flags.Parse(args)
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	return selfTest(&client)
+}
+
+func runProbe(args []string) int {
+	var client clientFlags
+	flags := newSubcommandFlags("probe", &client)
+	flags.Parse(args)
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	return probeKeyservices(&client)
+}
+
+func runVersion(args []string) int {
+	newSubcommandFlags("version", nil).Parse(args)
+	fmt.Printf("win-secrets %s (commit %s, date %s)\n", Version, Commit, Date)
+	return 0
+}
+
+// selfTest decrypts the first leaf of every secrets file and reports which
+// key service unwrapped its data key
+func selfTest(client *clientFlags) int {
+	ksMode, err := client.validate()
+	if err != nil {
+		cliLog.Error("Invalid settings", "error", err)
+		return 2
+	}
+	for _, spec := range client.secrets {
+		LogSopsRecipients(spec.path, spec.format)
+	}
+	sc, err := client.newClient()
+	if err != nil {
+		cliLog.Error("Failed to configure SOPS keyservice", "error", err)
+		return 1
+	}
+	defer sc.Close()
+	cliLog.Info("Self-test key services", "mode", string(ksMode), "services", strings.Join(sc.serviceNames(), ", "))
+
+	for _, spec := range client.secrets {
+		testPath := findTestKeyPath(sc, spec)
+		if testPath == nil {
+			cliLog.Error("Self-test could not find a suitable test key path", "mount", spec.name)
+			return 1
+		}
+
+		val, err := sc.DecryptKey(context.Background(), spec.path, spec.format, testPath)
+		if err != nil {
+			cliLog.Error("Self-test FAIL", "mount", spec.name, "error", err)
+			return 1
+		}
+		servedBy := sc.ServedBy(spec.path)
+		cliLog.Info("Self-test OK", "mount", spec.name, "bytes", len(val), "served_by", strings.Join(servedBy, ", "))
+		if ksMode == keyserviceBoth && slices.Contains(servedBy, localKeyserviceName) {
+			cliLog.Warn("Self-test data key came from local keys or credentials, not the remote keyservice", "mount", spec.name)
+		}
+	}
+	sc.WipeTrees()
+	return 0
+}
+
+// probeKeyservices probes every -keyservice endpoint, printing one JSON
+// result per line
+func probeKeyservices(client *clientFlags) int {
+	if err := configureSOPSKeyservice(client.keyserviceAddr); err != nil {
+		keyserviceLog.Error("Failed to configure SOPS keyservice", "error", err)
+		return 2
+	}
+
+	endpoints, err := parseKeyserviceEndpoints(client.keyserviceAddr)
+	if err != nil {
+		keyserviceLog.Error("Invalid keyservice endpoints", "error", err)
+		return 2
+	}
+
+	failed := 0
+	enc := json.NewEncoder(os.Stdout)
+	for _, endpoint := range endpoints {
+		res := probeKeyservice(context.Background(), endpoint, client.tls)
+		if err := enc.Encode(res); err != nil {
+			cliLog.Error("Cannot write output", "error", err)
+			return 1
+		}
+		if err := res.err(); err != nil {
+			keyserviceLog.Error("Probe FAIL", "endpoint", endpoint, "error", err)
+			failed++
+			continue
+		}
+		keyserviceLog.Info("Probe OK", "endpoint", endpoint, "decrypt_code", res.DecryptCode, "decrypt_latency", res.DecryptLatency, "health", res.Health)
+	}
+	if failed > 0 {
+		keyserviceLog.Error("Keyservice endpoints failed", "failed", failed, "endpoints", len(endpoints))
+		return 1
+	}
+	return 0
+}
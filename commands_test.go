@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+)
+
+// dataKeyServer is a keyservice that unwraps every key to the same data key
+type dataKeyServer struct {
+	keyservice.UnimplementedKeyServiceServer
+	dataKey []byte
+}
+
+func (s dataKeyServer) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	return &keyservice.DecryptResponse{Plaintext: s.dataKey}, nil
+}
+
+// serveDataKey serves dataKeyServer on a unix socket until the test ends and
+// returns its -keyservice endpoint
+func serveDataKey(t *testing.T, dataKey []byte) string {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "ks.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(srv, dataKeyServer{dataKey: dataKey})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return "unix://" + sock
+}
+
+// captureStdout runs fn with os.Stdout redirected and returns what it printed
+func captureStdout(t *testing.T, fn func() int) (string, int) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	code := fn()
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+	return string(out), code
+}
+
+func TestParseInterspersed(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "")
+	got := parseInterspersed(flags, []string{"a/b", "-json", "c"})
+	if !slices.Equal(got, []string{"a/b", "c"}) || !*asJSON {
+		t.Errorf("Expected [a/b c] with -json, got %q json=%v", got, *asJSON)
+	}
+}
+
+// isolateUserConfig points the per-user config directory at an empty
+// directory, so a developer's own config file does not leak into tests
+func isolateUserConfig(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("AppData", dir)
+	t.Setenv("HOME", dir)
+	return dir
+}
+
+func TestGetAndLsCommands(t *testing.T) {
+	isolateUserConfig(t)
+	dataKey := make([]byte, 32)
+	path := writeEncryptedFixture(t, "api_keys:\n  openrouter: sk-or-1\npostgres:\n  pass: s3cret\n  hosts:\n    - a.lan\n", dataKey)
+	endpoint := serveDataKey(t, dataKey)
+
+	common := []string{"-keyservice", endpoint, "-secrets", "prod=" + path}
+	tests := []struct {
+		name string
+		run  func([]string) int
+		args []string
+		code int
+		out  string
+	}{
+		{name: "get", run: runGet, args: []string{"postgres/pass"}, out: "s3cret"},
+		{name: "get with mount name", run: runGet, args: []string{"prod/api_keys/openrouter"}, out: "sk-or-1"},
+		{name: "get json", run: runGet, args: []string{"postgres/hosts/0", "-json"}, out: "{\"path\":\"prod/postgres/hosts/0\",\"value\":\"a.lan\"}\n"},
+		{name: "get rendered subtree", run: runGet, args: []string{"postgres.env"}, out: "hosts_0=a.lan\npass=s3cret\n"},
+		{name: "get directory", run: runGet, args: []string{"postgres"}, code: 1},
+		{name: "get missing", run: runGet, args: []string{"nope"}, code: 1},
+		{name: "get without path", run: runGet, code: 2},
+		{name: "ls", run: runLs, out: "prod/\n"},
+		{name: "ls subtree", run: runLs, args: []string{"postgres"}, out: "hosts/\npass\n"},
+		{name: "ls recursive", run: runLs, args: []string{"-r"}, out: "prod/api_keys/openrouter\nprod/postgres/hosts/0\nprod/postgres/pass\n"},
+		{name: "ls json", run: runLs, args: []string{"postgres", "-json"}, out: "{\n  \"hosts\": {\n    \"0\": null\n  },\n  \"pass\": null\n}\n"},
+		{name: "ls leaf", run: runLs, args: []string{"postgres/pass"}, out: "prod/postgres/pass\n"},
+		{name: "ls missing", run: runLs, args: []string{"nope"}, code: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, code := captureStdout(t, func() int { return tt.run(append(slices.Clone(common), tt.args...)) })
+			if code != tt.code || out != tt.out {
+				t.Errorf("Expected exit %d with %q, got %d with %q", tt.code, tt.out, code, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the YAML config file. Every setting maps onto a flag and only
+// applies when that flag is not given on the command line. Relative paths are
+// relative to the config file.
+type fileConfig struct {
+	Keyservice struct {
+		Endpoints []string `yaml:"endpoints"`
+		Mode      string   `yaml:"mode"`
+		TLS       struct {
+			CA         string `yaml:"ca"`
+			Cert       string `yaml:"cert"`
+			Key        string `yaml:"key"`
+			ServerName string `yaml:"server_name"`
+		} `yaml:"tls"`
+	} `yaml:"keyservice"`
+	Secrets []struct {
+		Name   string `yaml:"name"`
+		Path   string `yaml:"path"`
+		Format string `yaml:"format"`
+	} `yaml:"secrets"`
+	Format         string  `yaml:"format"`
+	Mount          *string `yaml:"mount"` // "" serves only the HTTP API
+	Templates      string  `yaml:"templates"`
+	ReloadInterval string  `yaml:"reload_interval"`
+	OfflineGrace   string  `yaml:"offline_grace"`
+	SizeMode       string  `yaml:"size_mode"`
+	CacheTTL       []struct {
+		Glob string `yaml:"glob"`
+		TTL  string `yaml:"ttl"`
+	} `yaml:"cache_ttl"`
+	ServeHTTP struct {
+		Listen    string `yaml:"listen"`
+		TokenFile string `yaml:"token_file"`
+	} `yaml:"serve_http"`
+	Audit struct {
+		File       string `yaml:"file"`
+		RotateSize string `yaml:"rotate_size"`
+		Keep       string `yaml:"keep"`
+	} `yaml:"audit"`
+	Logging struct {
+		File   string `yaml:"file"`
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"logging"`
+}
+
+// configValue is one config setting as the flag it stands for
+type configValue struct {
+	key   string // YAML key, for errors
+	flag  string
+	value string
+}
+
+// defaultConfigFile is win-secrets/config.yaml in the per-user config
+// directory (%AppData% on Windows, ~/.config elsewhere)
+func defaultConfigFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "win-secrets", "config.yaml"), nil
+}
+
+// loadConfigFile parses a config file, rejecting unknown keys and secrets
+// formats so a typo does not silently fall back to a default
+func loadConfigFile(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	// -secrets would take an unknown :format for part of the path
+	for i, s := range cfg.Secrets {
+		if err := validateStoreFormat(s.Format); err != nil {
+			return nil, fmt.Errorf("%s: secrets[%d].format: %w", path, i, err)
+		}
+	}
+	return &cfg, nil
+}
+
+// values lists the settings present in the file, resolving relative paths
+// against dir
+func (cfg *fileConfig) values(dir string) []configValue {
+	var vals []configValue
+	add := func(key, flag, value string) {
+		if value != "" {
+			vals = append(vals, configValue{key: key, flag: flag, value: value})
+		}
+	}
+	file := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	ks := cfg.Keyservice
+	add("keyservice.endpoints", "keyservice", strings.Join(ks.Endpoints, ","))
+	add("keyservice.mode", "keyservice-mode", ks.Mode)
+	add("keyservice.tls.ca", "keyservice-ca", file(ks.TLS.CA))
+	add("keyservice.tls.cert", "keyservice-cert", file(ks.TLS.Cert))
+	add("keyservice.tls.key", "keyservice-key", file(ks.TLS.Key))
+	add("keyservice.tls.server_name", "keyservice-server-name", ks.TLS.ServerName)
+
+	for i, s := range cfg.Secrets {
+		key := fmt.Sprintf("secrets[%d]", i)
+		if s.Path == "" {
+			// Let -secrets reject it
+			add(key, "secrets", s.Name+"=")
+			continue
+		}
+		spec := file(s.Path)
+		if s.Format != "" {
+			spec += ":" + s.Format
+		}
+		if s.Name == "" {
+			add(key, "secrets", spec)
+			continue
+		}
+		add(key, "secrets", s.Name+"="+spec)
+	}
+	add("format", "format", cfg.Format)
+
+	if cfg.Mount != nil {
+		vals = append(vals, configValue{key: "mount", flag: "mount", value: *cfg.Mount})
+	}
+	add("templates", "templates", file(cfg.Templates))
+	add("reload_interval", "reload-interval", cfg.ReloadInterval)
+	add("offline_grace", "offline-grace", cfg.OfflineGrace)
+	add("size_mode", "size-mode", cfg.SizeMode)
+	for i, r := range cfg.CacheTTL {
+		add(fmt.Sprintf("cache_ttl[%d]", i), "cache-ttl", r.Glob+"="+r.TTL)
+	}
+	add("serve_http.listen", "serve-http", cfg.ServeHTTP.Listen)
+	add("serve_http.token_file", "http-token-file", file(cfg.ServeHTTP.TokenFile))
+	add("audit.file", "audit-log", file(cfg.Audit.File))
+	add("audit.rotate_size", "audit-rotate-size", cfg.Audit.RotateSize)
+	add("audit.keep", "audit-keep", cfg.Audit.Keep)
+	add("logging.file", "log-file", file(cfg.Logging.File))
+	add("logging.level", "log-level", cfg.Logging.Level)
+	add("logging.format", "log-format", cfg.Logging.Format)
+	return vals
+}
+
+// applyConfig sets every flag of flags that the command line left unset and
+// the config file has a value for. Settings for flags the command does not
+// have are ignored.
+func applyConfig(flags *flag.FlagSet, cfg *fileConfig, dir string) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	for _, v := range cfg.values(dir) {
+		if given[v.flag] || flags.Lookup(v.flag) == nil {
+			continue
+		}
+		if err := flags.Set(v.flag, v.value); err != nil {
+			return fmt.Errorf("%s: %w", v.key, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig applies the -config file, or the default one if it exists, to
+// the flags left unset
+func (c *clientFlags) loadConfig(flags *flag.FlagSet) error {
+	path, explicit := c.configPath, c.configPath != ""
+	if !explicit {
+		var err error
+		if path, err = defaultConfigFile(); err != nil {
+			return nil
+		}
+	}
+
+	cfg, err := loadConfigFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := applyConfig(flags, cfg, filepath.Dir(path)); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	c.configPath = path
+	return nil
+}
+
+// configure loads the config file and then sets up logging from -log-file,
+// -log-level and -log-format
+func (c *clientFlags) configure(flags *flag.FlagSet) error {
+	if err := c.loadConfig(flags); err != nil {
+		return err
+	}
+
+	levels, err := parseLogLevels(c.logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid -log-level: %w", err)
+	}
+	var w io.Writer = os.Stderr
+	if c.logFile != "" {
+		f, err := os.OpenFile(c.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("log file: %w", err)
+		}
+		w = f
+	}
+	if err := setupLogging(w, c.logFormat, levels); err != nil {
+		return fmt.Errorf("invalid -log-format: %w", err)
+	}
+	if c.configPath != "" {
+		cliLog.Info("Loaded config file", "file", c.configPath)
+	}
+	return nil
+}
+
+// runConfig implements "win-secrets config validate": it applies the config
+// file to the mount flags and checks everything the mount would check at
+// startup, without contacting a keyservice
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintf(os.Stderr, "Usage: win-secrets config validate [flags]\n")
+		return 2
+	}
+
+	var m mountFlags
+	flags := newSubcommandFlags("config", nil)
+	m.register(flags)
+	flags.Parse(args[1:])
+
+	if err := m.client.loadConfig(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 1
+	}
+	if m.client.configPath == "" {
+		path, _ := defaultConfigFile()
+		cliLog.Error("No config file and no -config given", "path", path)
+		return 1
+	}
+
+	if err := m.check(); err != nil {
+		cliLog.Error("Config check failed", "file", m.client.configPath, "error", err)
+		return 1
+	}
+	fmt.Printf("%s: OK (%d secrets files, keyservice %s, mount %q)\n", m.client.configPath, len(m.client.secrets), m.client.keyserviceAddr, m.mountPoint)
+	return 0
+}
+
+// check validates the mount settings and the files and addresses they name
+func (m *mountFlags) check() error {
+	if _, _, err := m.validate(); err != nil {
+		return err
+	}
+	if _, err := parseKeyserviceEndpoints(m.client.keyserviceAddr); err != nil {
+		return err
+	}
+	for _, spec := range m.client.secrets {
+		if _, err := (&SopsClient{}).GetSecretsStructure(spec.path, spec.format); err != nil {
+			return fmt.Errorf("secrets %s: %w", spec.name, err)
+		}
+	}
+	if m.templatesDir != "" {
+		if fi, err := os.Stat(m.templatesDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("templates %s is not a directory", m.templatesDir)
+		}
+	}
+	if m.serveHTTP != "" {
+		if _, err := apiEndpoint(m.serveHTTP); err != nil {
+			return fmt.Errorf("serve_http: %w", err)
+		}
+	}
+	if _, err := parseLogLevels(m.client.logLevel); err != nil {
+		return fmt.Errorf("logging.level: %w", err)
+	}
+	if _, err := newLogHandler(io.Discard, m.client.logFormat); err != nil {
+		return fmt.Errorf("logging.format: %w", err)
+	}
+	return nil
+}
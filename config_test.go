@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfig(t *testing.T) {
+	isolateUserConfig(t)
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `
+keyservice:
+  endpoints: [tcp://ks1.lan:5000, unix:///run/sops.sock]
+  mode: both
+  tls:
+    ca: certs/ca.pem
+    server_name: sops-keyservice.lan
+secrets:
+  - name: prod
+    path: prod.yaml
+  - path: /abs/home.conf
+    format: dotenv
+mount: ""
+reload_interval: 0
+offline_grace: 1h
+cache_ttl:
+  - glob: prod/**
+    ttl: 30s
+serve_http:
+  listen: 127.0.0.1:8200
+audit:
+  file: audit.jsonl
+  rotate_size: 5
+  keep: 3
+logging:
+  file: win-secrets.log
+  level: warn,fs=debug
+  format: json
+`)
+
+	var m mountFlags
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	m.register(flags)
+	if err := flags.Parse([]string{"-config", path, "-keyservice-mode", "remote", "-cache-ttl", "home/**=0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.client.loadConfig(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	c := m.client
+	if c.keyserviceAddr != "tcp://ks1.lan:5000,unix:///run/sops.sock" || c.mode != "remote" {
+		t.Errorf("Expected endpoints from the file and mode from the flag, got %q %q", c.keyserviceAddr, c.mode)
+	}
+	if c.tls.caFile != filepath.Join(dir, "certs", "ca.pem") || c.tls.serverName != "sops-keyservice.lan" {
+		t.Errorf("Unexpected TLS settings %+v", c.tls)
+	}
+	if c.secrets.String() != "prod="+filepath.Join(dir, "prod.yaml")+",secrets=/abs/home.conf:dotenv" {
+		t.Errorf("Unexpected secrets %s", c.secrets.String())
+	}
+	if len(m.cacheTTLs) != 1 || m.cacheTTLs[0].glob != "home/**" {
+		t.Errorf("Expected -cache-ttl to replace the file's rules, got %+v", m.cacheTTLs)
+	}
+	if m.mountPoint != "" || m.reloadInterval != 0 || m.offlineGrace != time.Hour || m.serveHTTP != "127.0.0.1:8200" {
+		t.Errorf("Unexpected mount settings %+v", m)
+	}
+	if m.audit.file != filepath.Join(dir, "audit.jsonl") || m.audit.rotateMB != 5 || m.audit.keep != 3 {
+		t.Errorf("Unexpected audit settings %q %d %d", m.audit.file, m.audit.rotateMB, m.audit.keep)
+	}
+	if c.logFile != filepath.Join(dir, "win-secrets.log") || c.logLevel != "warn,fs=debug" || c.logFormat != "json" {
+		t.Errorf("Unexpected logging settings %q %q %q", c.logFile, c.logLevel, c.logFormat)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	userDir := isolateUserConfig(t)
+
+	load := func(args ...string) (*mountFlags, error) {
+		var m mountFlags
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		m.register(flags)
+		if err := flags.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return &m, m.client.loadConfig(flags)
+	}
+
+	// No default file is fine, a missing -config is not
+	if m, err := load(); err != nil || m.client.configPath != "" {
+		t.Errorf("Expected no config, got %q (%v)", m.client.configPath, err)
+	}
+	if _, err := load("-config", filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("Expected a missing -config file to fail")
+	}
+
+	// The default file is discovered in the user config directory
+	os.MkdirAll(filepath.Join(userDir, "win-secrets"), 0700)
+	writeConfig(t, filepath.Join(userDir, "win-secrets"), "mount: \"Z:\"\n")
+	if m, err := load(); err != nil || m.mountPoint != "Z:" {
+		t.Errorf("Expected mount Z: from the default config, got %q (%v)", m.mountPoint, err)
+	}
+
+	for content, want := range map[string]string{
+		"mout: \"Z:\"\n":                               "field mout not found",
+		"offline_grace: soon\n":                        "offline_grace",
+		"cache_ttl:\n  - glob: '['\n    ttl: 1s\n":     "cache_ttl[0]",
+		"secrets:\n  - name: prod\n":                   "secrets[0]",
+		"secrets:\n  - path: a.env\n    format: env\n": "secrets[0].format",
+	} {
+		path := writeConfig(t, t.TempDir(), content)
+		if _, err := load("-config", path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error mentioning %q for %q, got %v", want, content, err)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	isolateUserConfig(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secrets.yaml"), []byte(sopsFixture("token: ENC[a]\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	good := writeConfig(t, dir, "secrets:\n  - path: secrets.yaml\nmount: \"Z:\"\n")
+	if code := runConfig([]string{"validate", "-config", good}); code != 0 {
+		t.Errorf("Expected a valid config to pass, got exit %d", code)
+	}
+
+	for _, content := range []string{
+		"secrets:\n  - path: missing.yaml\n",
+		"secrets:\n  - path: secrets.yaml\nmount: \"\"\n",
+		"secrets:\n  - path: secrets.yaml\nserve_http:\n  listen: 0.0.0.0:8200\n",
+		"secrets:\n  - path: secrets.yaml\nkeyservice:\n  mode: cloud\n",
+	} {
+		path := writeConfig(t, t.TempDir(), content)
+		if code := runConfig([]string{"validate", "-config", path}); code != 1 {
+			t.Errorf("Expected %q to fail validation, got exit %d", content, code)
+		}
+	}
+
+	if code := runConfig(nil); code != 2 {
+		t.Errorf("Expected usage error without validate, got %d", code)
+	}
+}
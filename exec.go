@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// envMapping is one -env NAME=ref or -env-prefix PREFIX=ref argument. A ref
+// is a path below the mount point, and may leave out the mount name to refer
+// to the first -secrets file, as in templates.
+type envMapping struct {
+	name string
+	ref  string
+}
+
+// envFlag is a repeatable NAME=ref flag
+type envFlag []envMapping
+
+func (f *envFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, m := range *f {
+		parts[i] = m.name + "=" + m.ref
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *envFlag) Set(v string) error {
+	name, ref, ok := strings.Cut(v, "=")
+	ref = strings.Trim(ref, "/")
+	if !ok || ref == "" {
+		return fmt.Errorf("%q: want NAME=key/path", v)
+	}
+	if name == "" || name != envName(name) {
+		return fmt.Errorf("%q: %q is not a valid variable name", v, name)
+	}
+	*f = append(*f, envMapping{name: name, ref: ref})
+	return nil
+}
+
+// runExec implements "win-secrets exec [flags] -- command [args...]": it
+// decrypts the mapped secrets without mounting anything, runs the command
+// with them in its environment and returns its exit code
+func runExec(args []string) int {
+	var client clientFlags
+	flags := newSubcommandFlags("exec", &client)
+	var audit auditFlags
+	audit.register(flags)
+	var vars, prefixes envFlag
+	flags.Var(&vars, "env", "Variable to set from one secret, as NAME=key/path (repeatable)")
+	flags.Var(&prefixes, "env-prefix", "Variables to set from every value in a subtree, as PREFIX=key/path; postgres/admin_pass under PG_=postgres becomes PG_ADMIN_PASS (repeatable)")
+	flags.Parse(args)
+
+	if err := client.configure(flags); err != nil {
+		cliLog.Error("Invalid configuration", "error", err)
+		return 2
+	}
+	command := flags.Args()
+	if len(command) == 0 || len(vars)+len(prefixes) == 0 {
+		flags.Usage()
+		return 2
+	}
+	fs, err := client.openAudited(&audit)
+	if err != nil {
+		cliLog.Error("Cannot open secrets", "error", err)
+		return 1
+	}
+	env, err := fs.secretEnv(vars, prefixes)
+	fs.close()
+	if err != nil {
+		cliLog.Error("Cannot resolve environment", "error", err)
+		return 1
+	}
+
+	return runChild(command, env)
+}
+
+// secretEnv resolves the mappings to NAME=value entries, recording each read
+// in the audit log. Subtrees come first so an explicit -env overrides a
+// variable from -env-prefix.
+func (fs *SopsFS) secretEnv(vars, prefixes []envMapping) ([]string, error) {
+	var env, names []string
+	set := func(name, path string) error {
+		var secret string
+		hit, err := fs.withSecret(path, func(b []byte) { secret = string(b) })
+		if aerr := fs.audit.recordFor(processCaller(), auditExec, path, []secretAccess{newSecretAccess(path, hit)}, auditErrno(err)); aerr != nil {
+			return fmt.Errorf("%s (%s): audit log: %w", name, path, aerr)
+		}
+		if err != nil {
+			return fmt.Errorf("%s (%s): %w", name, path, err)
+		}
+		env = append(env, name+"="+secret)
+		names = append(names, name)
+		return nil
+	}
+
+	for _, m := range prefixes {
+		path := fs.secretRefPath(m.ref)
+		node, ok := fs.lookup(path)
+		if !ok || !node.isDir() {
+			return nil, fmt.Errorf("-env-prefix %s=%s: not a subtree", m.name, m.ref)
+		}
+		leaves := make(map[string]interface{})
+		collectLeaves(node.value, "", leaves)
+		keys := make([]string, 0, len(leaves))
+		for k := range leaves {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			if err := set(m.name+strings.ToUpper(envName(k)), path+"/"+k); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, m := range vars {
+		if err := set(m.name, fs.secretRefPath(m.ref)); err != nil {
+			return nil, err
+		}
+	}
+
+	cliLog.Info("Setting environment variables", "count", len(names), "names", strings.Join(names, ", "))
+	return env, nil
+}
+
+// runChild runs command with env added to this process's environment,
+// forwarding termination signals, and returns its exit code. A child killed
+// by a signal exits 128+signal, as in a shell.
+func runChild(command, env []string) int {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(sigChan)
+		close(sigChan)
+	}()
+
+	if err := cmd.Start(); err != nil {
+		cliLog.Error("Cannot start command", "command", command[0], "error", err)
+		return 127
+	}
+	go func() {
+		for sig := range sigChan {
+			// On Windows the console already delivers Ctrl+C to the child and
+			// Signal only supports Kill, so a failure here is expected
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		cliLog.Error("Command failed", "command", command[0], "error", err)
+		return 1
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
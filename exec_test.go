@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEnvFlag(t *testing.T) {
+	var f envFlag
+	for _, v := range []string{"OPENROUTER_API_KEY=api_keys/openrouter", "PG_=/postgres/"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if got := f.String(); got != "OPENROUTER_API_KEY=api_keys/openrouter,PG_=postgres" {
+		t.Errorf("Unexpected flag value %q", got)
+	}
+
+	for _, v := range []string{"NAME", "NAME=", "BAD-NAME=x", "=x/y"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	fs, ks := mountFixture(t, "secrets", "api_keys:\n  openrouter: sk-or-1\npostgres:\n  admin_pass: s3cret\n  host: db.lan\n  replicas:\n    - a.lan\n", nil)
+
+	vars := []envMapping{{name: "OPENROUTER_API_KEY", ref: "api_keys/openrouter"}, {name: "PG_HOST", ref: "secrets/api_keys/openrouter"}}
+	prefixes := []envMapping{{name: "PG_", ref: "postgres"}}
+	env, err := fs.secretEnv(vars, prefixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"PG_ADMIN_PASS=s3cret",
+		"PG_HOST=db.lan",
+		"PG_REPLICAS_0=a.lan",
+		"OPENROUTER_API_KEY=sk-or-1",
+		"PG_HOST=sk-or-1", // an explicit -env comes last and wins
+	}
+	if !slices.Equal(env, want) {
+		t.Errorf("Expected %q, got %q", want, env)
+	}
+	if ks.calls != 1 {
+		t.Errorf("Expected one data-key unwrap for every variable, got %d", ks.calls)
+	}
+
+	if _, err := fs.secretEnv(nil, []envMapping{{name: "X_", ref: "api_keys/openrouter"}}); err == nil {
+		t.Errorf("Expected -env-prefix on a leaf to fail")
+	}
+	if _, err := fs.secretEnv([]envMapping{{name: "X", ref: "missing"}}, nil); err == nil {
+		t.Errorf("Expected a missing secret to fail")
+	}
+}
+
+// TestExecHelperProcess is the child started by TestRunChild
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv("WIN_SECRETS_EXEC_HELPER") != "1" {
+		return
+	}
+	fmt.Print(os.Getenv("INJECTED"))
+	if os.Getenv("INJECTED") != "s3cret" {
+		os.Exit(3)
+	}
+	os.Exit(7)
+}
+
+func TestRunChild(t *testing.T) {
+	t.Setenv("WIN_SECRETS_EXEC_HELPER", "1")
+	command := []string{os.Args[0], "-test.run=^TestExecHelperProcess$"}
+
+	if code := runChild(command, []string{"INJECTED=s3cret"}); code != 7 {
+		t.Errorf("Expected the child's exit code 7, got %d", code)
+	}
+	if code := runChild(command, []string{"INJECTED=other"}); code != 3 {
+		t.Errorf("Expected exit code 3 without the secret, got %d", code)
+	}
+	if code := runChild([]string{strings.Repeat("x", 8) + "-no-such-command"}, nil); code != 127 {
+		t.Errorf("Expected 127 for a missing command, got %d", code)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// secretsAPI serves the mounted tree over HTTP for tools that cannot use the
+// FUSE mount. It reads through the same SopsFS, so both frontends share one
+// structure, decrypt cache and keyservice pool.
+type secretsAPI struct {
+	fs    *SopsFS
+	token []byte
+}
+
+// newSecretsAPI returns the /v1 handler, requiring "Authorization: Bearer
+// <token>" on every request
+func newSecretsAPI(fs *SopsFS, token string) http.Handler {
+	api := &secretsAPI{fs: fs, token: []byte(token)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/secrets/{path...}", api.getSecret)
+	mux.HandleFunc("GET /v1/tree", api.getTree)
+	mux.HandleFunc("POST /v1/cache/flush", api.flushCache)
+	mux.HandleFunc("DELETE /v1/offline-grace", api.dropOfflineGrace)
+	return api.authenticate(mux)
+}
+
+func (api *secretsAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), api.token) != 1 {
+			httpLog.Warn("Unauthorized request", "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="win-secrets"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getSecret returns one file of the mount, addressed exactly as below the
+// mount point: /v1/secrets/secrets/postgres/admin_pass, .../postgres.json,
+// .../cert.b64d or /v1/secrets/templates/pgpass
+func (api *secretsAPI) getSecret(w http.ResponseWriter, r *http.Request) {
+	path := "/" + r.PathValue("path")
+	httpLog.Debug("GET secret", "path", path)
+
+	// Copy out of the locked buffer so a slow client cannot hold the cache lock
+	var data []byte
+	accessed, err := api.fs.withFile(path, func(b []byte) { data = bytes.Clone(b) })
+	defer clear(data)
+	if aerr := api.fs.audit.recordFor(httpCaller(r), auditHTTP, path, accessed, auditErrno(err)); aerr != nil {
+		httpLog.Error("Cannot write audit record, denying request", "path", path, "error", aerr)
+		apiError(w, ErrInternal)
+		return
+	}
+	if err != nil {
+		httpLog.Warn("Cannot read secret", "path", path, "error", err)
+		apiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// getTree lists every mounted file, template and key as nested objects whose
+// leaves are null; no values, encrypted or not, are included
+func (api *secretsAPI) getTree(w http.ResponseWriter, r *http.Request) {
+	httpLog.Debug("GET tree")
+
+	tree := make(map[string]any, len(api.fs.fileNames)+1)
+	for _, name := range api.fs.fileNames {
+		sf := api.fs.files[name]
+		if sf.binary {
+			tree[name] = nil
+			continue
+		}
+		sf.mu.RLock()
+		root := sf.tree
+		sf.mu.RUnlock()
+		tree[name] = treeListing(root)
+	}
+
+	if api.fs.templatesDir != "" {
+		names, err := api.fs.templateNames()
+		if err != nil {
+			httpLog.Error("Cannot list templates", "error", err)
+			apiError(w, err)
+			return
+		}
+		templates := make(map[string]any, len(names))
+		for _, n := range names {
+			templates[n] = nil
+		}
+		tree[templatesRoot] = templates
+	}
+
+	writeJSON(w, tree)
+}
+
+// flushCache wipes every cached value and decrypted tree; offline grace data
+// keys are kept, see dropOfflineGrace
+func (api *secretsAPI) flushCache(w http.ResponseWriter, r *http.Request) {
+	n := api.fs.flushCache()
+	httpLog.Info("Flushed cached values", "flushed", n)
+	writeJSON(w, map[string]int{"flushed": n})
+}
+
+// dropOfflineGrace wipes the offline grace data keys along with every cached
+// value and decrypted tree, like deleting the .offline-grace control file
+func (api *secretsAPI) dropOfflineGrace(w http.ResponseWriter, r *http.Request) {
+	if !api.fs.isGraceControl("/" + graceControlFile) {
+		apiError(w, ErrNotFound)
+		return
+	}
+	n := api.fs.wipeSecrets()
+	httpLog.Info("Dropped offline data keys and all decrypted values", "data_keys", n)
+	writeJSON(w, map[string]int{"dropped": n})
+}
+
+// httpCaller identifies the client of r by its address; a unix socket client
+// has none, so the socket it connected to is recorded
+func httpCaller(r *http.Request) auditCaller {
+	c := unknownCaller
+	c.remote = r.RemoteAddr
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		c.remote = "unix:" + addr.String()
+	}
+	return c
+}
+
+// treeListing mirrors the directory structure of node with null leaves
+func treeListing(node interface{}) any {
+	if !isDirNode(node) {
+		return nil
+	}
+	listing := make(map[string]any)
+	childEntries(node, func(name string, value interface{}) {
+		listing[name] = treeListing(value)
+	})
+	return listing
+}
+
+func apiError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, ErrKeyserviceUnavailable):
+		w.Header().Set("Retry-After", "5")
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		httpLog.Warn("Cannot write response", "error", err)
+	}
+}
+
+// listenAPI listens on a unix socket (unix:///path, unix-abstract:name) or a
+// loopback TCP address. Other interfaces are refused since the API hands out
+// plaintext.
+func listenAPI(addr string) (net.Listener, error) {
+	e, err := apiEndpoint(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.network != "unix" || strings.HasPrefix(e.address, "@") {
+		return net.Listen(e.network, e.address)
+	}
+
+	// Remove a socket left behind by a previous run
+	if fi, err := os.Lstat(e.address); err == nil && fi.Mode().Type() == os.ModeSocket {
+		os.Remove(e.address)
+	}
+	ln, err := listenSocket(e.network, e.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(e.address, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// apiEndpoint parses a -serve-http address, refusing TCP addresses other
+// than loopback
+func apiEndpoint(addr string) (keyserviceEndpoint, error) {
+	e, err := parseKeyserviceEndpoint(addr)
+	if err != nil {
+		return keyserviceEndpoint{}, err
+	}
+	if e.network == "tcp" {
+		host, _, _ := net.SplitHostPort(e.address)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return keyserviceEndpoint{}, fmt.Errorf("%s is not a loopback address", addr)
+		}
+	}
+	return e, nil
+}
+
+// defaultAPITokenFile is win-secrets/http-token in the per-user config directory
+func defaultAPITokenFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "win-secrets", "http-token"), nil
+}
+
+// loadAPIToken reads the bearer token from path, first creating the file with
+// a random token readable only by this user if it does not exist
+func loadAPIToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", err
+		}
+		token := hex.EncodeToString(raw)
+		_, err = f.WriteString(token + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", err
+		}
+		httpLog.Info("Generated a new API token", "token_file", path)
+		return token, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// startAPI serves the HTTP API on addr until the returned server is closed
+func startAPI(fs *SopsFS, addr, tokenFile string) (*http.Server, error) {
+	if tokenFile == "" {
+		var err error
+		if tokenFile, err = defaultAPITokenFile(); err != nil {
+			return nil, err
+		}
+	}
+	token, err := loadAPIToken(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("API token: %w", err)
+	}
+
+	ln, err := listenAPI(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: newSecretsAPI(fs, token), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			httpLog.Error("Server stopped", "error", err)
+		}
+	}()
+	httpLog.Info("Serving API", "listen", addr, "token_file", tokenFile)
+	return srv, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSecretsAPI(t *testing.T) {
+	fs, ks := mountFixture(t, "secrets", "postgres:\n  user: admin\n  pass: s3cret\ndns:\n  - 1.1.1.1\n", nil)
+
+	srv := httptest.NewServer(newSecretsAPI(fs, "t0k3n"))
+	defer srv.Close()
+
+	do := func(method, path, token string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if code, _ := do("GET", "/v1/secrets/secrets/postgres/pass", token); code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 with token %q, got %d", token, code)
+		}
+	}
+	if ks.calls != 0 {
+		t.Fatalf("Expected no decrypt before authentication, got %d", ks.calls)
+	}
+
+	// A read through the mount warms the cache the API serves from
+	buff := make([]byte, 64)
+	if n := fs.Read("/secrets/postgres/pass", buff, 0, 0); string(buff[:max(n, 0)]) != "s3cret" {
+		t.Fatalf("Read returned %q", buff[:max(n, 0)])
+	}
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{path: "/v1/secrets/secrets/postgres/pass", code: http.StatusOK, body: "s3cret"},
+		{path: "/v1/secrets/secrets/postgres.env", code: http.StatusOK, body: "pass=s3cret\nuser=admin\n"},
+		{path: "/v1/secrets/secrets/dns/0", code: http.StatusOK, body: "1.1.1.1"},
+		{path: "/v1/secrets/secrets/postgres", code: http.StatusNotFound},
+		{path: "/v1/secrets/secrets/missing", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		code, body := do("GET", tt.path, "t0k3n")
+		if code != tt.code || (tt.code == http.StatusOK && body != tt.body) {
+			t.Errorf("GET %s: expected %d %q, got %d %q", tt.path, tt.code, tt.body, code, body)
+		}
+	}
+	if ks.calls != 1 {
+		t.Errorf("Expected the mount and API to share one data-key unwrap, got %d", ks.calls)
+	}
+
+	code, body := do("GET", "/v1/tree", "t0k3n")
+	var tree map[string]any
+	if err := json.Unmarshal([]byte(body), &tree); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /v1/tree: %d %v", code, err)
+	}
+	want := map[string]any{"secrets": map[string]any{
+		"postgres": map[string]any{"user": nil, "pass": nil},
+		"dns":      map[string]any{"0": nil},
+	}}
+	if got, _ := json.Marshal(tree); string(got) != mustJSON(t, want) {
+		t.Errorf("Expected tree %s, got %s", mustJSON(t, want), got)
+	}
+
+	if code, _ := do("GET", "/v1/cache/flush", "t0k3n"); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET flush, got %d", code)
+	}
+	code, body = do("POST", "/v1/cache/flush", "t0k3n")
+	if code != http.StatusOK || body != "{\n  \"flushed\": 3\n}\n" {
+		t.Errorf("Expected 3 flushed values, got %d %q", code, body)
+	}
+	if len(fs.files["secrets"].cache) != 0 || len(fs.sopsClient.trees) != 0 {
+		t.Errorf("Expected flush to empty the value and tree caches")
+	}
+}
+
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestListenAPI(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:8200", "example.com:80"} {
+		if ln, err := listenAPI(addr); err == nil {
+			ln.Close()
+			t.Errorf("Expected %s to be refused", addr)
+		}
+	}
+
+	ln, err := listenAPI("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	sock := filepath.Join(t.TempDir(), "api.sock")
+	for range 2 {
+		// The second listen replaces the socket file the first one left behind
+		ln, err := net.Listen("unix", sock)
+		if err == nil {
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+			ln.Close()
+		}
+		ln, err = listenAPI("unix://" + sock)
+		if err != nil {
+			t.Fatalf("listenAPI(unix://%s): %v", sock, err)
+		}
+		fi, err := os.Stat(sock)
+		if err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("Expected socket mode 0600, got %v (%v)", fi.Mode(), err)
+		}
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+	}
+}
+
+func TestLoadAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "win-secrets", "http-token")
+	token, err := loadAPIToken(path)
+	if err != nil || len(token) != 64 {
+		t.Fatalf("Expected a generated 64-character token, got %q (%v)", token, err)
+	}
+	if fi, err := os.Stat(path); err != nil || (runtime.GOOS != "windows" && fi.Mode().Perm() != 0600) {
+		t.Errorf("Expected token file mode 0600, got %v (%v)", fi.Mode(), err)
+	}
+	if again, err := loadAPIToken(path); err != nil || again != token {
+		t.Errorf("Expected the same token on reload, got %q (%v)", again, err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	os.WriteFile(empty, []byte("\n"), 0600)
+	if _, err := loadAPIToken(empty); err == nil {
+		t.Errorf("Expected an empty token file to be rejected")
+	}
+}
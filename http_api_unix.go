@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenSocket creates a unix socket file that only the owner can connect to
+// from the moment it exists. The umask is process-wide, but it only narrows
+// the mode of files other goroutines create meanwhile.
+func listenSocket(network, address string) (net.Listener, error) {
+	old := unix.Umask(0177)
+	defer unix.Umask(old)
+	return net.Listen(network, address)
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// listenSocket creates a unix socket file. Windows has no umask; the socket
+// takes the ACL of its directory.
+func listenSocket(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
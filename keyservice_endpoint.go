@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// keyserviceEndpoint is a parsed -keyservice address. Every code path dials
+// through it, so tcp and unix sockets behave the same everywhere.
+type keyserviceEndpoint struct {
+	network string // "tcp" or "unix"
+	address string // host:port, a socket path, or "@name" for an abstract socket
+}
+
+// parseKeyserviceEndpoint accepts
+//
+//	host:port, tcp://host:port          TCP
+//	unix:///run/sops.sock, unix:path    Unix socket (e.g. forwarded with ssh -L)
+//	unix://@name, unix-abstract:name    Linux abstract socket
+func parseKeyserviceEndpoint(addr string) (keyserviceEndpoint, error) {
+	var e keyserviceEndpoint
+	switch {
+	case strings.HasPrefix(addr, "unix-abstract:"):
+		e = keyserviceEndpoint{network: "unix", address: "@" + strings.TrimPrefix(addr, "unix-abstract:")}
+	case strings.HasPrefix(addr, "unix://"):
+		e = keyserviceEndpoint{network: "unix", address: strings.TrimPrefix(addr, "unix://")}
+	case strings.HasPrefix(addr, "unix:"):
+		e = keyserviceEndpoint{network: "unix", address: strings.TrimPrefix(addr, "unix:")}
+	default:
+		e = keyserviceEndpoint{network: "tcp", address: strings.TrimPrefix(addr, "tcp://")}
+	}
+
+	if e.network == "unix" {
+		if e.address == "" || e.address == "@" {
+			return keyserviceEndpoint{}, fmt.Errorf("keyservice endpoint %q: missing socket path", addr)
+		}
+		return e, nil
+	}
+
+	if strings.Contains(e.address, "://") {
+		return keyserviceEndpoint{}, fmt.Errorf("keyservice endpoint %q: unsupported scheme", addr)
+	}
+	if _, _, err := net.SplitHostPort(e.address); err != nil {
+		return keyserviceEndpoint{}, fmt.Errorf("keyservice endpoint %q: %w", addr, err)
+	}
+	return e, nil
+}
+
+// parseKeyserviceEndpoints parses a comma-separated -keyservice list, in the
+// order the endpoints should be preferred
+func parseKeyserviceEndpoints(list string) ([]keyserviceEndpoint, error) {
+	var endpoints []keyserviceEndpoint
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		e, err := parseKeyserviceEndpoint(addr)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no keyservice endpoint in %q", list)
+	}
+	return endpoints, nil
+}
+
+// String returns the endpoint in the form the sops CLI expects in
+// SOPS_KEYSERVICE (tcp://host:port or unix://path)
+func (e keyserviceEndpoint) String() string {
+	return e.network + "://" + e.address
+}
+
+// target is the grpc dial target; the address is dialed by e.dial as is
+func (e keyserviceEndpoint) target() string {
+	return "passthrough:///" + e.address
+}
+
+func (e keyserviceEndpoint) dial(ctx context.Context, _ string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, e.network, e.address)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+)
+
+func TestParseKeyserviceEndpoint(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected keyserviceEndpoint
+		wantErr  bool
+	}{
+		{"sops-keyservice.lan:5000", keyserviceEndpoint{"tcp", "sops-keyservice.lan:5000"}, false},
+		{"tcp://10.0.0.5:5000", keyserviceEndpoint{"tcp", "10.0.0.5:5000"}, false},
+		{"tcp://[::1]:5000", keyserviceEndpoint{"tcp", "[::1]:5000"}, false},
+		{"unix:///run/sops.sock", keyserviceEndpoint{"unix", "/run/sops.sock"}, false},
+		{"unix:sops.sock", keyserviceEndpoint{"unix", "sops.sock"}, false},
+		{"unix://@sops", keyserviceEndpoint{"unix", "@sops"}, false},
+		{"unix-abstract:sops", keyserviceEndpoint{"unix", "@sops"}, false},
+		{"sops-keyservice.lan", keyserviceEndpoint{}, true},
+		{"tcp:/sops-keyservice.lan:5000", keyserviceEndpoint{}, true},
+		{"http://sops-keyservice.lan:5000", keyserviceEndpoint{}, true},
+		{"unix://", keyserviceEndpoint{}, true},
+		{"unix-abstract:", keyserviceEndpoint{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseKeyserviceEndpoint(tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseKeyserviceEndpoint(%q): unexpected error %v", tt.addr, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("parseKeyserviceEndpoint(%q) = %+v, expected %+v", tt.addr, got, tt.expected)
+		}
+	}
+}
+
+// startSocketKeyservice serves the SOPS keyservice in cleartext on a unix socket
+func startSocketKeyservice(t *testing.T, address string) {
+	t.Helper()
+	lis, err := net.Listen("unix", address)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(srv, keyservice.Server{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+}
+
+func TestDialUnixKeyservice(t *testing.T) {
+	addrs := []string{"unix://" + filepath.Join(t.TempDir(), "ks.sock")}
+	if runtime.GOOS == "linux" {
+		addrs = append(addrs, "unix-abstract:win-secrets-test-"+time.Now().Format("150405.000000000"))
+	}
+
+	for _, addr := range addrs {
+		endpoint, err := parseKeyserviceEndpoint(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		startSocketKeyservice(t, endpoint.address)
+
+		c, err := NewSopsClient(addr, keyserviceTLS{}, keyserviceRemote)
+		if err != nil {
+			t.Fatalf("NewSopsClient(%s): %v", addr, err)
+		}
+		defer c.Close()
+
+		remote := c.services[0]
+		key := keyservice.Key{KeyType: &keyservice.Key_AgeKey{AgeKey: &keyservice.AgeKey{Recipient: fixtureRecipient}}}
+		if _, err := remote.Encrypt(context.Background(), &keyservice.EncryptRequest{Key: &key, Plaintext: []byte("data key")}); err != nil {
+			t.Errorf("Encrypt over %s: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// keyserviceBackoff paces reconnection attempts to an endpoint that is down
+var keyserviceBackoff = backoff.Config{
+	BaseDelay:  time.Second,
+	Multiplier: 1.6,
+	Jitter:     0.2,
+	MaxDelay:   30 * time.Second,
+}
+
+// keyserviceStartupWait is how long NewSopsClient waits for the endpoints to
+// connect before reporting which are reachable; it never fails on them
+var keyserviceStartupWait = 3 * time.Second
+
+// keyserviceCallTimeout bounds each data-key request; SOPS calls the key
+// services without a deadline, so a dead endpoint would otherwise stall a read
+const keyserviceCallTimeout = 5 * time.Second
+
+// localKeyserviceName identifies the in-process key service in logs
+const localKeyserviceName = "local"
+
+// keyserviceMode selects which key services may unwrap data keys
+type keyserviceMode string
+
+const (
+	// keyserviceRemote uses only the -keyservice endpoints
+	keyserviceRemote keyserviceMode = "remote"
+	// keyserviceLocal uses only the in-process client, i.e. the age keys, PGP
+	// keyring and cloud credentials of the current user
+	keyserviceLocal keyserviceMode = "local"
+	// keyserviceBoth tries the local client first, then the endpoints
+	keyserviceBoth keyserviceMode = "both"
+)
+
+func parseKeyserviceMode(s string) (keyserviceMode, error) {
+	switch keyserviceMode(s) {
+	case keyserviceRemote, keyserviceLocal, keyserviceBoth:
+		return keyserviceMode(s), nil
+	default:
+		return "", fmt.Errorf("unknown keyservice mode %q (want %q, %q or %q)", s, keyserviceRemote, keyserviceLocal, keyserviceBoth)
+	}
+}
+
+func (m keyserviceMode) useLocal() bool  { return m == keyserviceLocal || m == keyserviceBoth }
+func (m keyserviceMode) useRemote() bool { return m == keyserviceRemote || m == keyserviceBoth }
+
+// trackedKeyservice is one key service, a remote endpoint or the local client,
+// with the health observed on its recent calls
+type trackedKeyservice struct {
+	name   string
+	client keyservice.KeyServiceClient
+	conn   *grpc.ClientConn // nil for the local client
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int // consecutive transport failures
+	lastErr  error
+}
+
+func newTrackedKeyservice(name string, client keyservice.KeyServiceClient, conn *grpc.ClientConn) *trackedKeyservice {
+	return &trackedKeyservice{name: name, client: client, conn: conn, healthy: true}
+}
+
+func (s *trackedKeyservice) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, keyserviceCallTimeout)
+	defer cancel()
+
+	rsp, err := s.client.Encrypt(ctx, req, opts...)
+	s.record(err)
+	return rsp, err
+}
+
+func (s *trackedKeyservice) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, keyserviceCallTimeout)
+	defer cancel()
+
+	rsp, err := s.client.Decrypt(ctx, req, opts...)
+	s.record(err)
+	return rsp, err
+}
+
+// record updates the health from a call result. Only transport failures count
+// against an endpoint: an error from a server that answered (e.g. it lacks the
+// identity for one recipient) says nothing about its availability.
+func (s *trackedKeyservice) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if isTransportError(err) {
+		if s.healthy {
+			keyserviceLog.Warn("Key service unhealthy", "service", s.name, "error", err)
+		}
+		s.healthy = false
+		s.failures++
+		s.lastErr = err
+		return
+	}
+
+	if !s.healthy {
+		keyserviceLog.Info("Key service healthy again", "service", s.name, "failures", s.failures)
+	}
+	s.healthy = true
+	s.failures = 0
+	s.lastErr = nil
+}
+
+// connectKeyservice creates the connection to an endpoint without waiting for
+// it; grpc keeps reconnecting with keyserviceBackoff while it is unreachable
+func connectKeyservice(endpoint keyserviceEndpoint, tlsCfg keyserviceTLS) (*trackedKeyservice, error) {
+	opts, err := keyserviceDialOptions(endpoint, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.WithConnectParams(grpc.ConnectParams{
+		Backoff:           keyserviceBackoff,
+		MinConnectTimeout: keyserviceCallTimeout,
+	}))
+
+	conn, err := grpc.NewClient(endpoint.target(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dial keyservice %s: %w", endpoint, err)
+	}
+
+	svc := newTrackedKeyservice(endpoint.String(), keyservice.NewKeyServiceClient(conn), conn)
+	conn.Connect()
+	go svc.watchConnection()
+	return svc, nil
+}
+
+// watchConnection logs connectivity changes until the connection is closed,
+// and reconnects when grpc lets an idle connection drop so IsConnected keeps
+// reflecting whether the endpoint is reachable
+func (s *trackedKeyservice) watchConnection() {
+	state := s.conn.GetState()
+	for state != connectivity.Shutdown {
+		if !s.conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		next := s.conn.GetState()
+		keyserviceLog.Info("Connection state changed", "service", s.name, "from", state.String(), "to", next.String())
+		if next == connectivity.Idle {
+			s.conn.Connect()
+		}
+		state = next
+	}
+}
+
+// waitReady waits until the connection is ready or ctx expires, marking the
+// endpoint unhealthy if it never came up
+func (s *trackedKeyservice) waitReady(ctx context.Context) bool {
+	for {
+		state := s.conn.GetState()
+		if state == connectivity.Ready {
+			return true
+		}
+		if !s.conn.WaitForStateChange(ctx, state) {
+			s.mu.Lock()
+			s.healthy = false
+			s.lastErr = fmt.Errorf("not connected (%s)", s.conn.GetState())
+			s.mu.Unlock()
+			return false
+		}
+	}
+}
+
+// isHealthy reports whether the service should be tried before the others. An
+// endpoint marked down counts as healthy again once grpc has reconnected it.
+func (s *trackedKeyservice) isHealthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.healthy && s.conn != nil && s.conn.GetState() == connectivity.Ready {
+		return true
+	}
+	return s.healthy
+}
+
+func isTransportError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// orderedServices returns the key services in the order SOPS should try them:
+// healthy ones first, otherwise in the configured order. Unhealthy endpoints
+// stay in the list so they are still used if nothing else can decrypt.
+func (c *SopsClient) orderedServices() []*trackedKeyservice {
+	svcs := slices.Clone(c.services)
+	slices.SortStableFunc(svcs, func(a, b *trackedKeyservice) int {
+		ha, hb := a.isHealthy(), b.isHealthy()
+		switch {
+		case ha == hb:
+			return 0
+		case ha:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return svcs
+}
+
+// serviceNames lists the configured key services in configured order
+func (c *SopsClient) serviceNames() []string {
+	names := make([]string, len(c.services))
+	for i, svc := range c.services {
+		names[i] = svc.name
+	}
+	return names
+}
+
+// attributedKeyservice records which services unwrapped a data key during one
+// decrypt
+type attributedKeyservice struct {
+	*trackedKeyservice
+	servedBy *[]string
+}
+
+func (a attributedKeyservice) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	rsp, err := a.trackedKeyservice.Decrypt(ctx, req, opts...)
+	if err != nil {
+		keyserviceLog.Warn("Key service could not unwrap data key", "service", a.name, "error", err)
+		return rsp, err
+	}
+	*a.servedBy = append(*a.servedBy, a.name)
+	return rsp, err
+}
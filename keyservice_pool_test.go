@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	yamlstore "github.com/getsops/sops/v3/stores/yaml"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeKeyservice answers data-key requests without real key material
+type fakeKeyservice struct {
+	dataKey []byte
+	err     error
+	calls   int
+}
+
+func (f *fakeKeyservice) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, opts ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "encrypt")
+}
+
+func (f *fakeKeyservice) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &keyservice.DecryptResponse{Plaintext: f.dataKey}, nil
+}
+
+// writeEncryptedFixture writes plain YAML encrypted with dataKey and a single
+// age recipient, so any key service handing out dataKey can decrypt it
+func writeEncryptedFixture(t *testing.T, plain string, dataKey []byte) string {
+	t.Helper()
+	store := yamlstore.NewStore(&config.YAMLStoreConfig{})
+	branches, err := store.LoadPlainFile([]byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := sops.Tree{Branches: branches, Metadata: sops.Metadata{
+		KeyGroups:    []sops.KeyGroup{{&age.MasterKey{Recipient: fixtureRecipient, EncryptedKey: "x"}}},
+		LastModified: time.Now().UTC().Truncate(time.Second),
+		Version:      "3.11.0",
+	}}
+	cipher := aes.NewCipher()
+	mac, err := tree.Encrypt(dataKey, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Metadata.MessageAuthenticationCode, err = cipher.Encrypt(mac, dataKey, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// mountFixture mounts plain YAML under name with the given cache policy. The
+// file is encrypted with a zero data key, which ks hands out as the client's
+// only key service.
+func mountFixture(t *testing.T, name, plain string, policy cachePolicy) (*SopsFS, *fakeKeyservice) {
+	t.Helper()
+	ks := &fakeKeyservice{dataKey: make([]byte, 32)}
+	path := writeEncryptedFixture(t, plain, ks.dataKey)
+	client := &SopsClient{
+		services: []*trackedKeyservice{newTrackedKeyservice("tcp://ks1:5000", ks, nil)},
+		trees:    make(map[string]*decryptedTree),
+	}
+	fs, err := NewSopsFS(client, []secretsSpec{{name: name, path: path}}, sizeFromEnvelope, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, ks
+}
+
+func TestDecryptFailsOverToHealthyKeyservice(t *testing.T) {
+	dataKey := make([]byte, 32)
+	path := writeEncryptedFixture(t, "postgres:\n  admin_pass: hunter2\n", dataKey)
+
+	down := &fakeKeyservice{err: status.Error(codes.Unavailable, "connection refused")}
+	up := &fakeKeyservice{dataKey: dataKey}
+	c := &SopsClient{
+		services: []*trackedKeyservice{
+			newTrackedKeyservice("tcp://ks1:5000", down, nil),
+			newTrackedKeyservice("tcp://ks2:5000", up, nil),
+		},
+		trees: make(map[string]*decryptedTree),
+	}
+
+	got, err := c.DecryptKey(context.Background(), path, "", []string{"postgres", "admin_pass"})
+	if err != nil {
+		t.Fatalf("DecryptKey: %v", err)
+	}
+	if got != "hunter2" {
+		t.Errorf("Expected hunter2, got %q", got)
+	}
+	if servedBy := c.ServedBy(path); !reflect.DeepEqual(servedBy, []string{"tcp://ks2:5000"}) {
+		t.Errorf("Expected the data key from ks2, got %v", servedBy)
+	}
+	if c.services[0].isHealthy() {
+		t.Errorf("Expected ks1 to be marked unhealthy")
+	}
+
+	// The next decrypt tries the healthy endpoint first
+	c.wipeTreeLocked(path)
+	down.calls, up.calls = 0, 0
+	if _, err := c.DecryptKey(context.Background(), path, "", []string{"postgres", "admin_pass"}); err != nil {
+		t.Fatalf("DecryptKey: %v", err)
+	}
+	if down.calls != 0 || up.calls != 1 {
+		t.Errorf("Expected only ks2 to be asked, got ks1=%d ks2=%d", down.calls, up.calls)
+	}
+}
+
+func TestKeyserviceHealthIgnoresServerErrors(t *testing.T) {
+	svc := newTrackedKeyservice("tcp://ks1:5000", &fakeKeyservice{}, nil)
+
+	svc.record(status.Error(codes.DeadlineExceeded, "timeout"))
+	if svc.isHealthy() {
+		t.Errorf("Expected a timeout to mark the endpoint unhealthy")
+	}
+
+	// An answer, even a refusal, means the endpoint is back
+	svc.record(errors.New("no identity matched any of the recipients"))
+	if !svc.isHealthy() || svc.failures != 0 {
+		t.Errorf("Expected a server error to mark the endpoint healthy, failures=%d", svc.failures)
+	}
+}
+
+func TestParseKeyserviceEndpoints(t *testing.T) {
+	got, err := parseKeyserviceEndpoints("ks1.lan:5000, unix:///run/ks.sock,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []keyserviceEndpoint{{"tcp", "ks1.lan:5000"}, {"unix", "/run/ks.sock"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+
+	if _, err := parseKeyserviceEndpoints(" , "); err == nil {
+		t.Errorf("Expected an empty list to be rejected")
+	}
+}
+
+func TestKeyserviceMode(t *testing.T) {
+	for _, m := range []string{"remote", "local", "both"} {
+		if _, err := parseKeyserviceMode(m); err != nil {
+			t.Errorf("parseKeyserviceMode(%q): %v", m, err)
+		}
+	}
+	if _, err := parseKeyserviceMode("remote-only"); err == nil {
+		t.Errorf("Expected unknown mode to be rejected")
+	}
+
+	// Local mode never dials, so the address is not even parsed
+	c, err := NewSopsClient("not an address", keyserviceTLS{}, keyserviceLocal)
+	if err != nil {
+		t.Fatalf("NewSopsClient: %v", err)
+	}
+	defer c.Close()
+	if names := c.serviceNames(); !reflect.DeepEqual(names, []string{localKeyserviceName}) {
+		t.Errorf("Expected only the local key service, got %v", names)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// probeTimeout bounds each step of a keyservice probe
+const probeTimeout = 3 * time.Second
+
+// Health states reported for servers that do not run the gRPC health service
+// or could not be asked
+const (
+	healthUnimplemented = "UNIMPLEMENTED"
+	healthUnknown       = "UNKNOWN"
+)
+
+// probeResult is the outcome of probing one keyservice endpoint
+type probeResult struct {
+	Endpoint string `json:"endpoint"`
+	OK       bool   `json:"ok"`
+
+	ConnectLatency time.Duration `json:"connect_latency_ns"`
+	ConnectError   string        `json:"connect_error,omitempty"`
+
+	// SpeaksSOPS is set when the Decrypt RPC answered the invalid request with
+	// a SOPS keyservice error rather than Unimplemented
+	SpeaksSOPS     bool          `json:"speaks_sops"`
+	DecryptLatency time.Duration `json:"decrypt_latency_ns"`
+	DecryptCode    string        `json:"decrypt_code,omitempty"`
+	DecryptMessage string        `json:"decrypt_message,omitempty"`
+
+	// Health is the grpc.health.v1 status of the server, UNIMPLEMENTED if it
+	// does not run the health service
+	Health        string        `json:"health"`
+	HealthLatency time.Duration `json:"health_latency_ns"`
+}
+
+// probeKeyservice checks that endpoint is a SOPS keyservice without touching
+// any key material: it calls KeyService/Decrypt with no key, which a SOPS
+// server rejects with NotFound before looking at identities or prompting, and
+// asks the standard gRPC health service for the server's status
+func probeKeyservice(ctx context.Context, endpoint keyserviceEndpoint, tlsCfg keyserviceTLS) probeResult {
+	res := probeResult{Endpoint: endpoint.String(), Health: healthUnknown}
+
+	start := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	conn, err := dialKeyservice(dialCtx, endpoint, tlsCfg)
+	cancel()
+	res.ConnectLatency = time.Since(start)
+	if err != nil {
+		res.ConnectError = err.Error()
+		return res
+	}
+	defer conn.Close()
+
+	callCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+	start = time.Now()
+	_, err = keyservice.NewKeyServiceClient(conn).Decrypt(callCtx, &keyservice.DecryptRequest{
+		Key:        &keyservice.Key{},
+		Ciphertext: []byte("win-secrets probe"),
+	})
+	cancel()
+	res.DecryptLatency = time.Since(start)
+	st := status.Convert(err)
+	res.DecryptCode = st.Code().String()
+	res.DecryptMessage = st.Message()
+	switch st.Code() {
+	case codes.OK:
+		// A keyless request can never decrypt; whatever answered is not SOPS
+	case codes.Unimplemented, codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+	default:
+		res.SpeaksSOPS = true
+	}
+
+	callCtx, cancel = context.WithTimeout(ctx, probeTimeout)
+	start = time.Now()
+	hc, err := healthpb.NewHealthClient(conn).Check(callCtx, &healthpb.HealthCheckRequest{})
+	cancel()
+	res.HealthLatency = time.Since(start)
+	switch {
+	case err == nil:
+		res.Health = hc.GetStatus().String()
+	case status.Code(err) == codes.Unimplemented:
+		res.Health = healthUnimplemented
+	}
+
+	res.OK = res.SpeaksSOPS && (res.Health == healthpb.HealthCheckResponse_SERVING.String() || res.Health == healthUnimplemented)
+	return res
+}
+
+// err summarizes why a probe failed, or returns nil if it passed
+func (r probeResult) err() error {
+	switch {
+	case r.OK:
+		return nil
+	case r.ConnectError != "":
+		return fmt.Errorf("connect: %s", r.ConnectError)
+	case !r.SpeaksSOPS:
+		return fmt.Errorf("not a SOPS keyservice: Decrypt returned %s: %s", r.DecryptCode, r.DecryptMessage)
+	default:
+		return errors.New("health check reports " + r.Health)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// serveProbeTarget starts a cleartext grpc server on a unix socket with the
+// services registered by register
+func serveProbeTarget(t *testing.T, register func(*grpc.Server)) keyserviceEndpoint {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "ks.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	srv := grpc.NewServer()
+	register(srv)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return keyserviceEndpoint{network: "unix", address: sock}
+}
+
+func withHealth(status healthpb.HealthCheckResponse_ServingStatus) func(*grpc.Server) {
+	return func(srv *grpc.Server) {
+		keyservice.RegisterKeyServiceServer(srv, keyservice.Server{})
+		hs := health.NewServer()
+		hs.SetServingStatus("", status)
+		healthpb.RegisterHealthServer(srv, hs)
+	}
+}
+
+func TestProbeKeyservice(t *testing.T) {
+	tests := []struct {
+		name       string
+		register   func(*grpc.Server)
+		ok         bool
+		speaksSOPS bool
+		health     string
+	}{
+		{
+			name:       "keyservice with health service",
+			register:   withHealth(healthpb.HealthCheckResponse_SERVING),
+			ok:         true,
+			speaksSOPS: true,
+			health:     "SERVING",
+		},
+		{
+			name:       "keyservice without health service",
+			register:   func(srv *grpc.Server) { keyservice.RegisterKeyServiceServer(srv, keyservice.Server{}) },
+			ok:         true,
+			speaksSOPS: true,
+			health:     healthUnimplemented,
+		},
+		{
+			name:       "keyservice reporting not serving",
+			register:   withHealth(healthpb.HealthCheckResponse_NOT_SERVING),
+			speaksSOPS: true,
+			health:     "NOT_SERVING",
+		},
+		{
+			name:     "some other grpc server",
+			register: func(srv *grpc.Server) {},
+			health:   healthUnimplemented,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := probeKeyservice(context.Background(), serveProbeTarget(t, tt.register), keyserviceTLS{})
+			if res.OK != tt.ok || res.SpeaksSOPS != tt.speaksSOPS || res.Health != tt.health {
+				t.Errorf("Unexpected result %+v", res)
+			}
+			if (res.err() == nil) != tt.ok {
+				t.Errorf("err() = %v for ok=%v", res.err(), res.OK)
+			}
+			if tt.speaksSOPS && res.DecryptCode != "NotFound" {
+				t.Errorf("Expected the keyless Decrypt to be rejected with NotFound, got %s", res.DecryptCode)
+			}
+		})
+	}
+}
+
+func TestProbeUnreachableKeyservice(t *testing.T) {
+	endpoint := keyserviceEndpoint{network: "unix", address: filepath.Join(t.TempDir(), "missing.sock")}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	res := probeKeyservice(ctx, endpoint, keyserviceTLS{})
+	if res.OK || res.ConnectError == "" || res.err() == nil {
+		t.Errorf("Expected a connect failure, got %+v", res)
+	}
+}
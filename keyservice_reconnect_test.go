@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadsFailWithEAGAINUntilKeyserviceConnects(t *testing.T) {
+	defer func(wait time.Duration, base time.Duration) {
+		keyserviceStartupWait, keyserviceBackoff.BaseDelay = wait, base
+	}(keyserviceStartupWait, keyserviceBackoff.BaseDelay)
+	keyserviceStartupWait = 100 * time.Millisecond
+	keyserviceBackoff.BaseDelay = 50 * time.Millisecond
+
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "ks.sock")
+	path := writeEncryptedFixture(t, "postgres:\n  admin_pass: hunter2\n", make([]byte, 32))
+
+	// The mount must come up while the keyservice is down
+	c, err := NewSopsClient("unix://"+sock, keyserviceTLS{}, keyserviceRemote)
+	if err != nil {
+		t.Fatalf("NewSopsClient with the keyservice down: %v", err)
+	}
+	defer c.Close()
+	if c.IsConnected() {
+		t.Errorf("Expected IsConnected to be false before the keyservice is up")
+	}
+
+	fs, err := NewSopsFS(c, []secretsSpec{{name: "secrets", path: path}}, sizeFromEnvelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 64)
+	if n := fs.Read("/secrets/postgres/admin_pass", buff, 0, 0); n != -11 {
+		t.Errorf("Expected EAGAIN while the keyservice is down, got %d", n)
+	}
+
+	startSocketKeyservice(t, sock)
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !c.IsConnected() {
+		t.Fatalf("Expected the client to reconnect in the background")
+	}
+
+	// Connected, but this keyservice holds no identity for the fixture: that
+	// is a decrypt failure, not unavailability
+	if n := fs.Read("/secrets/postgres/admin_pass", buff, 0, 0); n != -5 {
+		t.Errorf("Expected EIO from a reachable keyservice that cannot decrypt, got %d", n)
+	}
+}
+
+func TestIsConnectedWithLocalKeyservice(t *testing.T) {
+	c := &SopsClient{services: []*trackedKeyservice{newTrackedKeyservice(localKeyserviceName, &fakeKeyservice{}, nil)}}
+	if !c.IsConnected() {
+		t.Errorf("Expected the local key service to count as connected")
+	}
+	if (&SopsClient{}).IsConnected() {
+		t.Errorf("Expected a client without key services to be disconnected")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// keyserviceTLS configures transport security for the keyservice connection.
+// The zero value dials in cleartext; setting any field switches to TLS.
+type keyserviceTLS struct {
+	caFile     string // PEM CA bundle; system roots if empty
+	certFile   string // PEM client certificate for mutual TLS
+	keyFile    string // PEM private key for certFile
+	serverName string // overrides the name verified against the server certificate
+}
+
+func (t keyserviceTLS) enabled() bool {
+	return t != keyserviceTLS{}
+}
+
+// config builds the client TLS configuration, loading the CA bundle and the
+// client key pair from disk
+func (t keyserviceTLS) config() (*tls.Config, error) {
+	if (t.certFile == "") != (t.keyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.serverName,
+	}
+
+	if t.caFile != "" {
+		pem, err := os.ReadFile(t.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", t.caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// transportCredentials returns the gRPC credentials for the keyservice
+// connection: TLS when configured, cleartext otherwise
+func (t keyserviceTLS) transportCredentials() (credentials.TransportCredentials, error) {
+	if !t.enabled() {
+		return insecure.NewCredentials(), nil
+	}
+	cfg, err := t.config()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(cfg), nil
+}
+
+// dialKeyservice connects to a keyservice endpoint, blocking until the
+// connection (and TLS handshake, if any) is up or ctx expires
+func dialKeyservice(ctx context.Context, e keyserviceEndpoint, t keyserviceTLS) (*grpc.ClientConn, error) {
+	opts, err := keyserviceDialOptions(e, t)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.DialContext(ctx, e.target(), append(opts, grpc.WithBlock())...)
+}
+
+// keyserviceDialOptions returns the grpc options shared by every connection to
+// a keyservice endpoint
+func keyserviceDialOptions(e keyserviceEndpoint, t keyserviceTLS) ([]grpc.DialOption, error) {
+	creds, err := t.transportCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("keyservice TLS: %w", err)
+	}
+	// Dial the parsed endpoint ourselves rather than letting grpc re-parse
+	// the address, which it does differently for each scheme
+	opts := []grpc.DialOption{
+		grpc.WithContextDialer(e.dial),
+		grpc.WithTransportCredentials(creds),
+	}
+	if e.network == "unix" && t.serverName == "" {
+		// Sockets have no host name; use localhost like grpc does for
+		// unix targets
+		opts = append(opts, grpc.WithAuthority("localhost"))
+	}
+	return opts, nil
+}
+
+func (t keyserviceTLS) String() string {
+	switch {
+	case !t.enabled():
+		return "insecure"
+	case t.certFile != "":
+		return "mutual TLS"
+	default:
+		return "TLS"
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA issues certificates for an in-process keyservice and its clients
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "win-secrets test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key signed by the CA
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// startTLSKeyservice serves the SOPS keyservice on a loopback port, requiring
+// client certificates signed by ca
+func startTLSKeyservice(t *testing.T, ca *testCA) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "keyservice.test", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	keyservice.RegisterKeyServiceServer(srv, keyservice.Server{})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestKeyserviceMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	addr := startTLSKeyservice(t, ca)
+
+	certPEM, keyPEM := ca.issue(t, "win-secrets", x509.ExtKeyUsageClientAuth)
+	tlsCfg := keyserviceTLS{
+		caFile:     writeTestFile(t, dir, "ca.pem", ca.pem),
+		certFile:   writeTestFile(t, dir, "client.pem", certPEM),
+		keyFile:    writeTestFile(t, dir, "client-key.pem", keyPEM),
+		serverName: "keyservice.test",
+	}
+
+	c, err := NewSopsClient("tcp://"+addr, tlsCfg, keyserviceRemote)
+	if err != nil {
+		t.Fatalf("NewSopsClient: %v", err)
+	}
+	defer c.Close()
+
+	// The server only needs the recipient to encrypt, so a successful call
+	// proves the request crossed the mutually authenticated connection
+	remote := c.services[0]
+	key := keyservice.Key{KeyType: &keyservice.Key_AgeKey{AgeKey: &keyservice.AgeKey{Recipient: fixtureRecipient}}}
+	resp, err := remote.Encrypt(context.Background(), &keyservice.EncryptRequest{Key: &key, Plaintext: []byte("data key")})
+	if err != nil {
+		t.Fatalf("Encrypt over mutual TLS: %v", err)
+	}
+	if len(resp.Ciphertext) == 0 {
+		t.Errorf("Expected ciphertext from the keyservice")
+	}
+
+	// Without a client certificate the server must refuse the request
+	anon := tlsCfg
+	anon.certFile, anon.keyFile = "", ""
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dialKeyservice(ctx, keyserviceEndpoint{network: "tcp", address: addr}, anon)
+	if err == nil {
+		defer conn.Close()
+		_, err = keyservice.NewKeyServiceClient(conn).Encrypt(ctx, &keyservice.EncryptRequest{Key: &key, Plaintext: []byte("data key")})
+	}
+	if err == nil {
+		t.Errorf("Expected a connection without a client certificate to be rejected")
+	}
+}
+
+func TestKeyserviceTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	if (keyserviceTLS{}).enabled() {
+		t.Errorf("Expected the zero value to dial in cleartext")
+	}
+	if _, err := (keyserviceTLS{certFile: "client.pem"}).config(); err == nil {
+		t.Errorf("Expected a certificate without a key to be rejected")
+	}
+	bad := writeTestFile(t, dir, "empty.pem", []byte("not a certificate"))
+	if _, err := (keyserviceTLS{caFile: bad}).config(); err == nil {
+		t.Errorf("Expected a CA bundle without certificates to be rejected")
+	}
+
+	cfg, err := (keyserviceTLS{serverName: "keyservice.test"}).config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RootCAs != nil || cfg.ServerName != "keyservice.test" {
+		t.Errorf("Expected system roots and the server name override, got %+v", cfg)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// Subsystem loggers. Each can be given its own level with -log-level, e.g.
+// "warn,fs=debug" to trace FUSE callbacks without everything else.
+var (
+	fsLog         = newSubsystemLogger("fs")         // FUSE callbacks and templates
+	sopsLog       = newSubsystemLogger("sops")       // secrets files, decryption and reload
+	keyserviceLog = newSubsystemLogger("keyservice") // key service health, probes and data keys
+	cacheLog      = newSubsystemLogger("cache")      // decrypted value cache, locked memory, offline grace
+	httpLog       = newSubsystemLogger("http")       // -serve-http API
+	cliLog        = newSubsystemLogger("cli")        // startup, commands and config
+	auditLog      = newSubsystemLogger("audit")      // audit log opening, rotation and chain heads
+)
+
+var logSubsystems = []string{"fs", "sops", "keyservice", "cache", "http", "cli", "audit"}
+
+// redacted replaces anything that may hold plaintext in a log record
+const redacted = "[REDACTED]"
+
+// sensitiveLogKeys are attribute names whose values are never logged, whatever
+// their type
+var sensitiveLogKeys = []string{"value", "secret", "plaintext", "password", "token", "data_key", "env", "body"}
+
+// logLevels is a parsed -log-level: a default and per-subsystem overrides
+type logLevels struct {
+	level      slog.Level
+	subsystems map[string]slog.Level
+}
+
+// parseLogLevels accepts "info" or "warn,fs=debug,cache=debug"
+func parseLogLevels(spec string) (logLevels, error) {
+	levels := logLevels{level: slog.LevelInfo, subsystems: make(map[string]slog.Level)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, scoped := strings.Cut(part, "=")
+		if !scoped {
+			name = part
+		}
+
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return logLevels{}, fmt.Errorf("log level %q: want debug, info, warn or error", name)
+		}
+		if !scoped {
+			levels.level = level
+			continue
+		}
+		if !slices.Contains(logSubsystems, subsystem) {
+			return logLevels{}, fmt.Errorf("unknown log subsystem %q (want one of %s)", subsystem, strings.Join(logSubsystems, ", "))
+		}
+		levels.subsystems[subsystem] = level
+	}
+	return levels, nil
+}
+
+func (l logLevels) of(subsystem string) slog.Level {
+	if level, ok := l.subsystems[subsystem]; ok {
+		return level
+	}
+	return l.level
+}
+
+// logSink is the handler every subsystem logger writes through, swapped as a
+// whole once flags and config are known
+type logSink struct {
+	handler slog.Handler
+	levels  logLevels
+}
+
+var currentLogSink atomic.Pointer[logSink]
+
+func init() {
+	setupLogging(os.Stderr, "text", logLevels{level: slog.LevelInfo})
+}
+
+// newLogHandler creates the redacting text or JSON handler for w. Levels are
+// applied by the subsystem loggers, so it passes everything.
+func newLogHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: redactAttr}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("log format %q: want text or json", format)
+	}
+}
+
+// setupLogging sends every logger, and the standard log package, to w as
+// text or JSON records at the given levels
+func setupLogging(w io.Writer, format string, levels logLevels) error {
+	handler, err := newLogHandler(w, format)
+	if err != nil {
+		return err
+	}
+
+	currentLogSink.Store(&logSink{handler: handler, levels: levels})
+	slog.SetDefault(newSubsystemLogger("cli"))
+	// Library output through the log package arrives as a single message
+	log.SetFlags(0)
+	return nil
+}
+
+// redactAttr is the redaction layer: attributes with a sensitive name, or
+// inside a group with one, and raw bytes are replaced before anything is
+// formatted. secretBuffer redacts itself as a slog.LogValuer, which is
+// resolved before this runs.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	for _, name := range append(slices.Clone(groups), a.Key) {
+		if slices.Contains(sensitiveLogKeys, strings.ToLower(strings.ReplaceAll(name, "-", "_"))) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if a.Value.Kind() == slog.KindAny {
+		switch a.Value.Any().(type) {
+		case []byte, secretBuffer, *secretBuffer:
+			return slog.String(a.Key, redacted)
+		}
+	}
+	return a
+}
+
+// subsystemHandler tags records with their subsystem, applies its level and
+// writes them to the current sink. WithAttrs and WithGroup are replayed on
+// the sink for each record, so loggers created before setupLogging still
+// follow it.
+type subsystemHandler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= currentLogSink.Load().levels.of(h.subsystem)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := currentLogSink.Load().handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	return &subsystemHandler{subsystem: h.subsystem, ops: append(slices.Clone(h.ops), op)}
+}
+
+// fatal logs an error and exits, for startup failures in main
+func fatal(msg string, args ...any) {
+	cliLog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// captureLogs sends every logger to a JSON buffer at the given levels until
+// the test ends
+func captureLogs(t *testing.T, spec string) *bytes.Buffer {
+	t.Helper()
+	levels, err := parseLogLevels(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, "json", levels); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { setupLogging(os.Stderr, "text", logLevels{level: slog.LevelInfo}) })
+	return &buf
+}
+
+// logRecords decodes one JSON record per line
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	sc := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for sc.Scan() {
+		var r map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("Log line is not JSON: %q", sc.Text())
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels("warn, fs=debug,cache=ERROR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]slog.Level{"fs": slog.LevelDebug, "cache": slog.LevelError, "sops": slog.LevelWarn, "http": slog.LevelWarn}
+	for subsystem, level := range expected {
+		if got := levels.of(subsystem); got != level {
+			t.Errorf("Expected %s at %s, got %s", subsystem, level, got)
+		}
+	}
+	if levels, _ := parseLogLevels(""); levels.of("fs") != slog.LevelInfo {
+		t.Errorf("Expected info by default")
+	}
+
+	for _, spec := range []string{"loud", "fs=loud", "disk=debug", "=debug"} {
+		if _, err := parseLogLevels(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestSubsystemLogging(t *testing.T) {
+	buf := captureLogs(t, "warn,fs=debug,cli=info")
+
+	fsLog.Debug("Getattr", "path", "/secrets/a")
+	cacheLog.Info("Cache hit", "path", "/secrets/a")
+	cacheLog.Warn("Cannot lock memory")
+	sopsLog.With("file", "prod.yaml").Error("Decrypt failed")
+	log.Printf("from a library")
+
+	records := logRecords(t, buf)
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d:\n%s", len(records), buf)
+	}
+	expected := []struct{ subsystem, level, msg string }{
+		{"fs", "DEBUG", "Getattr"},
+		{"cache", "WARN", "Cannot lock memory"},
+		{"sops", "ERROR", "Decrypt failed"},
+		{"cli", "INFO", "from a library"},
+	}
+	for i, e := range expected {
+		r := records[i]
+		if r["subsystem"] != e.subsystem || r["level"] != e.level || r["msg"] != e.msg {
+			t.Errorf("Record %d: expected %+v, got %v", i, e, r)
+		}
+	}
+	if records[0]["path"] != "/secrets/a" || records[2]["file"] != "prod.yaml" {
+		t.Errorf("Expected attributes to be kept, got %v and %v", records[0], records[2])
+	}
+
+	if err := setupLogging(buf, "xml", logLevels{}); err == nil {
+		t.Errorf("Expected an unknown log format to be rejected")
+	}
+}
+
+func TestRedactAttr(t *testing.T) {
+	buf := captureLogs(t, "debug")
+
+	secret := newSecretBuffer([]byte("hunter2"))
+	defer secret.wipe()
+	fsLog.Info("sensitive",
+		"value", "hunter2",
+		"Password", "hunter2",
+		"data-key", "hunter2",
+		"raw", []byte("hunter2"),
+		"buffer", secret,
+		slog.Group("env", "PGPASS", "hunter2"),
+		"path", "/secrets/wifi")
+	fsLog.Info("formatted", "buffer", secret.String())
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("Secret reached the log:\n%s", buf)
+	}
+	r := logRecords(t, buf)[0]
+	for _, key := range []string{"value", "Password", "data-key", "raw", "buffer"} {
+		if r[key] != redacted {
+			t.Errorf("Expected %s to be redacted, got %v", key, r[key])
+		}
+	}
+	if env, _ := r["env"].(map[string]any); env["PGPASS"] != redacted {
+		t.Errorf("Expected values in the env group to be redacted, got %v", r["env"])
+	}
+	if r["path"] != "/secrets/wifi" {
+		t.Errorf("Expected path to be logged, got %v", r["path"])
+	}
+}
+
+// TestLogsNeverContainPlaintext drives every path that handles decrypted
+// values at debug level and fails if any of them reaches the log
+func TestLogsNeverContainPlaintext(t *testing.T) {
+	isolateUserConfig(t)
+	canaries := []string{"canary-pass-7f3a", "canary-cert-91bd", "canary-token-c40e", "canary-rotated-5d2b"}
+	plain := "postgres:\n  pass: " + canaries[0] + "\n  user: admin\n" +
+		"cert: " + base64.StdEncoding.EncodeToString([]byte(canaries[1])) + "\n" +
+		"api:\n  token: " + canaries[2] + "\n" +
+		"serial: 0q\n" // malformed hex; the decoder's error names the q
+	buf := captureLogs(t, "debug")
+
+	fs, ks := mountFixture(t, "secrets", plain, cachePolicy{{glob: "secrets/api/**", ttl: 0}})
+	dataKey, path := ks.dataKey, fs.files["secrets"].path
+	fs.templatesDir = t.TempDir()
+	writeTestFile(t, fs.templatesDir, "pgpass", []byte(`db:5432:*:admin:{{ secret "postgres/pass" }}`))
+	writeTestFile(t, fs.templatesDir, "broken", []byte(`{{ secret "postgres/pass" }}{{ secret "postgres/nope" }}`))
+
+	// The mount: leaves, cache hits, rendered documents, transforms, templates
+	buff := make([]byte, 256)
+	for _, p := range []string{
+		"/secrets/postgres/pass", "/secrets/postgres/pass", "/secrets/postgres.env", "/secrets.json",
+		"/secrets/cert.b64d", "/secrets/api/token", "/templates/pgpass", "/templates/broken",
+		"/secrets/postgres/pass.hexd", "/secrets/postgres/user.b64d", "/secrets/serial.hexd",
+	} {
+		var stat fuse.Stat_t
+		fs.Getattr(p, &stat, 0)
+		fs.Open(p, 0)
+		fs.Read(p, buff, 0, 0)
+	}
+
+	// exec
+	if _, err := fs.secretEnv([]envMapping{{name: "PGPASS", ref: "postgres/pass"}}, []envMapping{{name: "API_", ref: "api"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The HTTP API
+	var bodies strings.Builder
+	srv := httptest.NewServer(newSecretsAPI(fs, "t0k3n"))
+	for _, p := range []string{"/v1/secrets/secrets/postgres/pass", "/v1/secrets/templates/pgpass", "/v1/tree", "/v1/secrets/secrets/serial.hexd"} {
+		req, _ := http.NewRequest("GET", srv.URL+p, nil)
+		req.Header.Set("Authorization", "Bearer t0k3n")
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			io.Copy(&bodies, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	srv.Close()
+	if strings.Contains(bodies.String(), "'q'") {
+		t.Errorf("A byte of the malformed hex value reached an HTTP error:\n%s", bodies.String())
+	}
+
+	// Hot reload of a changed value
+	rotated := writeEncryptedFixture(t, strings.Replace(plain, canaries[0], canaries[3], 1), dataKey)
+	data, err := os.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.refreshSecretsStructure(fs.files["secrets"]); err != nil {
+		t.Fatal(err)
+	}
+	fs.Read("/secrets/postgres/pass", buff, 0, 0)
+	fs.wipeSecrets()
+
+	// The get command, logging through -log-file as configured by flags
+	endpoint := serveDataKey(t, dataKey)
+	logFile := filepath.Join(t.TempDir(), "win-secrets.log")
+	for _, ref := range []string{"postgres/pass", "cert.b64d", "postgres"} {
+		captureStdout(t, func() int {
+			return runGet([]string{"-keyservice", endpoint, "-secrets", path, "-log-level", "debug", "-log-format", "json", "-log-file", logFile, ref})
+		})
+	}
+	fileLogs, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() == 0 || len(fileLogs) == 0 {
+		t.Fatalf("Expected debug logs, got %d and %d bytes", buf.Len(), len(fileLogs))
+	}
+	for _, logs := range []string{buf.String(), string(fileLogs)} {
+		if strings.Contains(logs, "'q'") {
+			t.Errorf("A byte of the malformed hex value reached the log:\n%s", logs)
+		}
+		for _, canary := range canaries {
+			if strings.Contains(logs, canary) || strings.Contains(logs, base64.StdEncoding.EncodeToString([]byte(canary))) {
+				t.Errorf("Decrypted value %s reached the log:\n%s", canary, logs)
+			}
+		}
+	}
+}
@@ -2,21 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/winfsp/cgofuse/fuse"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"gopkg.in/yaml.v3"
 )
 
 // Populated at link time via -ldflags, with sane defaults for dev
@@ -33,7 +30,11 @@ func init() {
 			"win-secrets mounts a read-only virtual filesystem that exposes individual values from a SOPS-encrypted YAML file as files, decrypting on-demand via a remote SOPS keyservice over gRPC. No plaintext is written to disk; each read triggers decryption of just the requested key path and returns it as file content.\n\n",
 		)
 		fmt.Fprintf(flag.CommandLine.Output(), "Version: %s (commit %s, date %s)\n\n", Version, Commit, Date)
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n  win-secrets [flags]                mount the filesystem\n")
+		for _, c := range subcommands {
+			fmt.Fprintf(flag.CommandLine.Output(), "  win-secrets %-22s %s\n", c.name+" ...", c.summary)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nRun win-secrets <command> -help for the flags of a command.\n\nFlags:\n")
 		flag.PrintDefaults()
 	}
 }
@@ -41,11 +42,29 @@ func init() {
 var (
 	ErrNotFound = errors.New("not found")
 	ErrInternal = errors.New("internal error")
+	// ErrKeyserviceUnavailable means no key service could be reached; reads
+	// fail with EAGAIN so callers can retry once it is back
+	ErrKeyserviceUnavailable = errors.New("keyservice unavailable")
 )
 
+// errno maps a read error to the FUSE error code returned to the caller
+func errno(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return -2 // ENOENT
+	case errors.Is(err, ErrKeyserviceUnavailable):
+		return -11 // EAGAIN
+	default:
+		return -5 // EIO
+	}
+}
+
 type cachedSecret struct {
-	value     string
+	value     *secretBuffer // wiped on eviction, reload and unmount
 	timestamp time.Time
+	keyPath   string // "/"-joined key path the value was decrypted from
+	subtree   bool   // a rendered document depending on every key below keyPath
+	ttl       time.Duration
 }
 
 const (
@@ -53,24 +72,57 @@ const (
 	cacheCleanupPeriod = 10 * time.Minute
 )
 
+// sizeStrategy controls how Getattr reports the size of a secret file
+type sizeStrategy string
+
+const (
+	// sizeFromEnvelope derives the plaintext length from the base64 ciphertext
+	// in the ENC[AES256_GCM,data:...] envelope without contacting the keyservice
+	sizeFromEnvelope sizeStrategy = "envelope"
+	// sizeFromDecrypt decrypts the value on stat and reports its exact length
+	sizeFromDecrypt sizeStrategy = "decrypt"
+)
+
+func parseSizeStrategy(s string) (sizeStrategy, error) {
+	switch sizeStrategy(s) {
+	case sizeFromEnvelope, sizeFromDecrypt:
+		return sizeStrategy(s), nil
+	default:
+		return "", fmt.Errorf("unknown size mode %q (want %q or %q)", s, sizeFromEnvelope, sizeFromDecrypt)
+	}
+}
+
 type SopsFS struct {
 	fuse.FileSystemBase
-	sopsClient   *SopsClient
-	secretsPath  string
-	secretsTree  map[string]interface{}
-	secretsCache map[string]cachedSecret
-	mu           sync.RWMutex
+	sopsClient *SopsClient
+	sizeMode   sizeStrategy
+	// cachePolicy sets the TTL of each cached value from its key path
+	cachePolicy cachePolicy
+	files       map[string]*secretsFile
+	fileNames   []string // mount order, for a stable listing of "/"
+
+	templatesDir string      // exposed under /templates when set
+	audit        *auditTrail // records every secret read when set
+
+	uid, gid uint32 // owner of every file, see mountOwner
 }
 
-func NewSopsFS(sopsClient *SopsClient, secretsPath string) (*SopsFS, error) {
+func NewSopsFS(sopsClient *SopsClient, specs []secretsSpec, sizeMode sizeStrategy, policy cachePolicy) (*SopsFS, error) {
 	fs := &SopsFS{
-		sopsClient:   sopsClient,
-		secretsPath:  secretsPath,
-		secretsCache: make(map[string]cachedSecret),
+		sopsClient:  sopsClient,
+		sizeMode:    sizeMode,
+		cachePolicy: policy,
+		files:       make(map[string]*secretsFile, len(specs)),
 	}
+	fs.uid, fs.gid = mountOwner()
 
-	if err := fs.refreshSecretsStructure(); err != nil {
-		return nil, fmt.Errorf("failed to load secrets structure: %w", err)
+	for _, spec := range specs {
+		sf := newSecretsFile(spec)
+		if err := fs.refreshSecretsStructure(sf); err != nil {
+			return nil, fmt.Errorf("failed to load secrets structure for %s: %w", spec.name, err)
+		}
+		fs.files[spec.name] = sf
+		fs.fileNames = append(fs.fileNames, spec.name)
 	}
 
 	go fs.cacheCleanupLoop()
@@ -79,47 +131,169 @@ func NewSopsFS(sopsClient *SopsClient, secretsPath string) (*SopsFS, error) {
 }
 
 func (fs *SopsFS) cacheCleanupLoop() {
-	ticker := time.NewTicker(cacheCleanupPeriod)
+	period := fs.cachePolicy.cleanupPeriod()
+	cacheLog.Info("Cache cleanup scheduled", "period", period.String())
+	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		fs.mu.Lock()
-		now := time.Now()
-		for path, cached := range fs.secretsCache {
-			if now.Sub(cached.timestamp) > secretCacheTTL {
-				delete(fs.secretsCache, path)
-				log.Printf("[CacheCleanup] Removed expired cache entry for %s", path)
+		fs.purgeExpiredSecrets()
+		fs.sopsClient.PurgeExpiredTrees()
+	}
+}
+
+// purgeExpiredSecrets wipes cached values older than their TTL
+func (fs *SopsFS) purgeExpiredSecrets() {
+	now := time.Now()
+	for _, sf := range fs.files {
+		sf.mu.Lock()
+		for path, cached := range sf.cache {
+			if now.Sub(cached.timestamp) >= cached.ttl {
+				sf.evictLocked(path)
+				cacheLog.Debug("Wiped expired cache entry", "path", path)
 			}
 		}
-		fs.mu.Unlock()
+		sf.mu.Unlock()
 	}
 }
 
-func (fs *SopsFS) refreshSecretsStructure() error {
-	structure, err := fs.sopsClient.GetSecretsStructure(fs.secretsPath)
+// flushCache wipes every cached value and decrypted tree, keeping offline
+// data keys. It returns the number of values wiped.
+func (fs *SopsFS) flushCache() int {
+	n := 0
+	for _, sf := range fs.files {
+		n += sf.wipeCache()
+	}
+	fs.sopsClient.WipeTrees()
+	return n
+}
+
+// wipeSecrets wipes every cached value, decrypted tree and offline data key.
+// It returns the number of offline data keys dropped.
+func (fs *SopsFS) wipeSecrets() int {
+	fs.flushCache()
+	return fs.sopsClient.DropOfflineGrace()
+}
+
+func (fs *SopsFS) refreshSecretsStructure(sf *secretsFile) error {
+	structure, err := fs.sopsClient.GetSecretsStructure(sf.path, sf.format)
 	if err != nil {
 		return err
 	}
 
-	fs.mu.Lock()
-	fs.secretsTree = structure
-	fs.mu.Unlock()
+	sf.mu.Lock()
+	previous := sf.tree
+	sf.tree = structure
+	if previous != nil {
+		sf.logAndInvalidateChangesLocked(previous, structure)
+	}
+	sf.mu.Unlock()
 
-	log.Printf("[SopsFS] Loaded secrets structure with %d top-level keys", len(structure))
+	// The decrypted tree holds every value of the file, so it must not outlive
+	// the shortest TTL of any of them
+	fs.sopsClient.SetTreeTTL(sf.path, min(decryptedTreeTTL, fs.cachePolicy.subtreeTTL(sf.name, structure)))
+
+	sopsLog.Info("Loaded secrets structure", "mount", sf.name, "top_level_keys", len(structure))
 	return nil
 }
 
-func (fs *SopsFS) navigateToPath(keyPath []string) (interface{}, bool) {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
+// fsNode is a FUSE path resolved against a mounted secrets file
+type fsNode struct {
+	file    *secretsFile
+	keyPath []string
+	value   interface{}
+	// render is set for a virtual document (e.g. postgres.yaml) rendering the
+	// decrypted directory node at keyPath in that format
+	render string
+	// transform is set for a suffix (e.g. cert.b64d) that converts the content
+	// of the file it is appended to
+	transform *secretTransform
+}
 
-	var current interface{} = fs.secretsTree
-	for _, key := range keyPath {
-		m, ok := current.(map[string]interface{})
-		if !ok {
-			return nil, false
+// isDir reports whether the node is listed as a directory
+func (n fsNode) isDir() bool {
+	return n.render == "" && n.transform == nil && isDirNode(n.value)
+}
+
+// lookup resolves a FUSE path to its mounted file, key path and tree node.
+// The top-level directory of a file resolves to its whole tree, and a
+// directory name with a .yaml, .json or .env suffix resolves to a document
+// rendering that directory. A file name with a transform suffix such as .b64d
+// resolves to that file with the transform applied. Either suffix is ignored
+// when a key already has that name.
+func (fs *SopsFS) lookup(path string) (fsNode, bool) {
+	if base, t := splitTransformSuffix(path); t != nil {
+		if _, ok := fs.resolve(path); !ok {
+			if n, ok := fs.lookup(base); ok && !n.isDir() && n.transform == nil {
+				n.transform = t
+				return n, true
+			}
+		}
+	}
+	if base, format := splitRenderSuffix(path); format != "" {
+		if n, ok := fs.resolve(base); ok && isDirNode(n.value) {
+			// resolve falls back to stripping .yaml, so only a different key
+			// path is a real key
+			if real, ok := fs.resolve(path); ok && !slices.Equal(real.keyPath, n.keyPath) {
+				return real, true
+			}
+			n.render = format
+			return n, true
+		}
+	}
+	return fs.resolve(path)
+}
+
+// resolve looks path up as keys of its mounted file. Each name is first taken
+// as is, so a real key x.yaml is found, and only then without the .yaml or
+// .txt suffix that parseSopsKeyPath strips.
+func (fs *SopsFS) resolve(path string) (fsNode, bool) {
+	name, keyPath := parseSopsKeyPath(path)
+	sf, ok := fs.files[name]
+	if !ok {
+		return fsNode{}, false
+	}
+	keyPath = sf.resolveKeyPath(keyPath)
+	if names := strings.Split(strings.TrimPrefix(path, "/"), "/")[1:]; len(names) == len(keyPath) {
+		keyPath = fs.exactKeyPath(sf, names, keyPath)
+	}
+
+	value, exists := fs.navigateToPath(sf, keyPath)
+	if !exists {
+		return fsNode{}, false
+	}
+	return fsNode{file: sf, keyPath: keyPath, value: value}, true
+}
+
+// exactKeyPath replaces each stripped key with its name as given wherever the
+// tree has a key by that name
+func (fs *SopsFS) exactKeyPath(sf *secretsFile, names, keyPath []string) []string {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+
+	var current interface{} = sf.tree
+	for i, name := range names {
+		if name != keyPath[i] {
+			if _, ok := childNode(current, name); ok {
+				keyPath[i] = name
+			}
 		}
-		current, ok = m[key]
+		var ok bool
+		if current, ok = childNode(current, keyPath[i]); !ok {
+			break
+		}
+	}
+	return keyPath
+}
+
+func (fs *SopsFS) navigateToPath(sf *secretsFile, keyPath []string) (interface{}, bool) {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+
+	var current interface{} = sf.tree
+	for _, key := range keyPath {
+		var ok bool
+		current, ok = childNode(current, key)
 		if !ok {
 			return nil, false
 		}
@@ -128,177 +302,300 @@ func (fs *SopsFS) navigateToPath(keyPath []string) (interface{}, bool) {
 }
 
 func (fs *SopsFS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
-	log.Printf("[Getattr] path=%s", path)
+	fsLog.Debug("Getattr", "path", path)
 
+	stat.Uid, stat.Gid = fs.uid, fs.gid
 	if path == "/" {
-		stat.Mode = fuse.S_IFDIR | 0555
-		return 0
-	}
-
-	if path == "/secrets" {
-		stat.Mode = fuse.S_IFDIR | 0555
+		// Writable by the owner only, who may delete the grace control file
+		stat.Mode = fuse.S_IFDIR | 0755
 		return 0
 	}
 
-	if !strings.HasPrefix(path, "/secrets/") {
-		return -2 // ENOENT
+	if name, ok := fs.templateName(path); ok {
+		errc, accessed := fs.templateGetattr(name, stat)
+		return fs.auditStat(path, accessed, errc)
 	}
 
-	keyPath := parseSopsKeyPath(path)
-	if keyPath == nil {
-		return -2 // ENOENT
+	if fs.isGraceControl(path) {
+		stat.Mode = fuse.S_IFREG | 0400
+		stat.Size = int64(len(fs.sopsClient.grace.status()))
+		return 0
 	}
 
-	node, exists := fs.navigateToPath(keyPath)
+	node, exists := fs.lookup(path)
 	if !exists {
 		return -2 // ENOENT
 	}
 
-	if _, isMap := node.(map[string]interface{}); isMap {
+	if node.isDir() {
 		stat.Mode = fuse.S_IFDIR | 0555
 		return 0
 	}
 
+	size, accessed, err := fs.secretSize(node, path)
+	if err != nil {
+		fsLog.Warn("Cannot size secret", "path", path, "error", err)
+		return fs.auditStat(path, accessed, errno(err))
+	}
+
 	stat.Mode = fuse.S_IFREG | 0444
-	stat.Size = 4096
+	stat.Size = size
+	return fs.auditStat(path, accessed, 0)
+}
 
-	log.Printf("[Getattr] File %s exists, using default size", path)
-	return 0
+// auditStat records a Getattr that read secrets to size path, returning EIO
+// instead of errc if the record cannot be written
+func (fs *SopsFS) auditStat(path string, accessed []secretAccess, errc int) int {
+	if len(accessed) == 0 {
+		return errc
+	}
+	if err := fs.audit.record(auditStat, path, accessed, errc); err != nil {
+		fsLog.Error("Cannot write audit record, denying stat", "path", path, "error", err)
+		return -5 // EIO
+	}
+	return errc
+}
+
+// secretSize returns the plaintext length of the leaf at path, preferring an
+// already cached value, then the envelope (if allowed), then a real decrypt.
+// Only the decrypt is returned as a secret read.
+func (fs *SopsFS) secretSize(node fsNode, path string) (int64, []secretAccess, error) {
+	node.file.mu.RLock()
+	if cached, ok := node.file.cache[path]; ok && time.Since(cached.timestamp) < cached.ttl {
+		size := cached.value.Len()
+		node.file.mu.RUnlock()
+		return int64(size), nil, nil
+	}
+	node.file.mu.RUnlock()
+
+	if fs.sizeMode == sizeFromEnvelope && node.render == "" && node.transform == nil {
+		if size, ok := envelopeSize(node.value); ok {
+			return size, nil, nil
+		}
+	}
+
+	var size int
+	hit, err := fs.withSecret(path, func(secret []byte) { size = len(secret) })
+	return int64(size), []secretAccess{newSecretAccess(path, hit)}, err
+}
+
+// envelopeSize computes the plaintext length of an encrypted leaf from its
+// ENC[AES256_GCM,data:...] envelope. AES-GCM is a stream mode and SOPS stores
+// the tag separately, so the data field decodes to exactly the plaintext length.
+// Plain strings (unencrypted_suffix and friends) are their own content.
+func envelopeSize(node interface{}) (int64, bool) {
+	s, ok := node.(string)
+	if !ok {
+		return 0, false
+	}
+
+	const prefix = "ENC[AES256_GCM,data:"
+	if !strings.HasPrefix(s, prefix) {
+		if strings.HasPrefix(s, "ENC[") {
+			return 0, false
+		}
+		return int64(len(s)), true
+	}
+
+	data, _, found := strings.Cut(strings.TrimPrefix(s, prefix), ",")
+	if !found {
+		return 0, false
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return 0, false
+	}
+	return int64(len(raw)), true
 }
 
 func (fs *SopsFS) Open(path string, flags int) (int, uint64) {
-	log.Printf("[Open] path=%s flags=%d", path, flags)
+	fsLog.Debug("Open", "path", path, "flags", flags)
 
-	if !strings.HasPrefix(path, "/secrets/") {
-		return -2, 0 // ENOENT
+	errc := fs.open(path)
+	if err := fs.audit.record(auditOpen, path, nil, errc); err != nil {
+		fsLog.Error("Cannot write audit record, denying open", "path", path, "error", err)
+		return -5, 0 // EIO
 	}
+	return errc, 0
+}
 
-	keyPath := parseSopsKeyPath(path)
-	if keyPath == nil {
-		return -2, 0 // ENOENT
+func (fs *SopsFS) open(path string) int {
+	if fs.isGraceControl(path) {
+		return 0
+	}
+
+	if name, ok := fs.templateName(path); ok {
+		if name == "" {
+			return -21 // EISDIR
+		}
+		if _, err := fs.templateFile(name); err != nil {
+			return -2 // ENOENT
+		}
+		return 0
 	}
 
-	node, exists := fs.navigateToPath(keyPath)
+	node, exists := fs.lookup(path)
 	if !exists {
-		return -2, 0 // ENOENT
+		return -2 // ENOENT
 	}
 
-	if _, isMap := node.(map[string]interface{}); isMap {
-		return -21, 0 // EISDIR
+	if node.isDir() {
+		return -21 // EISDIR
 	}
 
-	return 0, 0
+	return 0
 }
 
 func (fs *SopsFS) Release(path string, fh uint64) int {
-	log.Printf("[Release] path=%s fh=%d", path, fh)
+	fsLog.Debug("Release", "path", path, "fh", fh)
 	return 0
 }
 
 func (fs *SopsFS) Read(path string, buff []byte, ofst int64, fh uint64) int {
-	log.Printf("[Read] path=%s offset=%d size=%d", path, ofst, len(buff))
+	fsLog.Debug("Read", "path", path, "offset", ofst, "size", len(buff))
 
-	if !strings.HasPrefix(path, "/secrets/") {
-		return -2 // ENOENT
-	}
-
-	secret, err := fs.readSecret(path)
+	var n int
+	accessed, err := fs.withFile(path, func(data []byte) {
+		if ofst < int64(len(data)) {
+			n = copy(buff, data[ofst:])
+		}
+	})
 	if err != nil {
-		log.Printf("[Read] Error reading secret: %v", err)
-		return -5 // EIO
+		n = errno(err)
+		fsLog.Warn("Cannot read file", "path", path, "error", err)
 	}
-
-	data := []byte(secret)
-	if ofst >= int64(len(data)) {
-		return 0
+	if err := fs.audit.record(auditRead, path, accessed, min(n, 0)); err != nil {
+		// The data is already in buff, but the kernel only passes on n bytes
+		fsLog.Error("Cannot write audit record, denying read", "path", path, "error", err)
+		return -5 // EIO
 	}
 
-	n := copy(buff, data[ofst:])
-	log.Printf("[Read] Returning %d bytes", n)
+	fsLog.Debug("Read done", "path", path, "result", n)
 	return n
 }
 
+// withFile calls fn with the content of any readable file: a template, the
+// offline grace control file or a secret, as for withSecret. It returns the
+// secrets read to produce the content.
+func (fs *SopsFS) withFile(path string, fn func(data []byte)) ([]secretAccess, error) {
+	if name, ok := fs.templateName(path); ok {
+		rendered, accessed, err := fs.renderTemplate(name)
+		if err != nil {
+			return accessed, err
+		}
+		fn([]byte(rendered))
+		return accessed, nil
+	}
+	if fs.isGraceControl(path) {
+		fn([]byte(fs.sopsClient.grace.status()))
+		return nil, nil
+	}
+	hit, err := fs.withSecret(path, fn)
+	if err != nil {
+		return nil, err
+	}
+	return []secretAccess{newSecretAccess(path, hit)}, nil
+}
+
 func (fs *SopsFS) Readdir(path string, fill func(name string, stat *fuse.Stat_t, ofst int64) bool, ofst int64, fh uint64) int {
-	log.Printf("[Readdir] path=%s", path)
+	fsLog.Debug("Readdir", "path", path)
 
 	fill(".", nil, 0)
 	fill("..", nil, 0)
+	entry := func(name string) { fs.fillEntry(fill, path, name) }
 
 	if path == "/" {
-		fill("secrets", &fuse.Stat_t{Mode: fuse.S_IFDIR | 0555}, 0)
-		return 0
-	}
-
-	if path == "/secrets" {
-		fs.mu.RLock()
-		defer fs.mu.RUnlock()
-
-		for name, value := range fs.secretsTree {
-			var mode uint32
-			if _, isMap := value.(map[string]interface{}); isMap {
-				mode = fuse.S_IFDIR | 0555
-			} else {
-				mode = fuse.S_IFREG | 0444
+		for _, name := range fs.fileNames {
+			entry(name)
+			if !fs.files[name].binary {
+				fillRenderSiblings(entry, name, nil)
 			}
-			fill(name, &fuse.Stat_t{Mode: mode}, 0)
+		}
+		if fs.templatesDir != "" {
+			entry(templatesRoot)
+		}
+		if fs.isGraceControl("/" + graceControlFile) {
+			entry(graceControlFile)
 		}
 		return 0
 	}
 
-	if !strings.HasPrefix(path, "/secrets/") {
-		return -2 // ENOENT
-	}
-
-	keyPath := parseSopsKeyPath(path)
-	if keyPath == nil {
-		return -2 // ENOENT
+	if name, ok := fs.templateName(path); ok {
+		if name != "" {
+			return -20 // ENOTDIR
+		}
+		names, err := fs.templateNames()
+		if err != nil {
+			fsLog.Error("Cannot list templates", "error", err)
+			return -5 // EIO
+		}
+		for _, n := range names {
+			entry(n)
+		}
+		return 0
 	}
 
-	node, exists := fs.navigateToPath(keyPath)
+	node, exists := fs.lookup(path)
 	if !exists {
 		return -2 // ENOENT
 	}
 
-	m, ok := node.(map[string]interface{})
-	if !ok {
+	if !node.isDir() {
 		return -20 // ENOTDIR
 	}
 
-	for name, value := range m {
-		var mode uint32
-		if _, isMap := value.(map[string]interface{}); isMap {
-			mode = fuse.S_IFDIR | 0555
-		} else {
-			mode = fuse.S_IFREG | 0444
+	childEntries(node.value, func(name string, value interface{}) {
+		entry(name)
+		if isDirNode(value) {
+			fillRenderSiblings(entry, name, node.value)
 		}
-		fill(name, &fuse.Stat_t{Mode: mode}, 0)
-	}
+	})
 
 	return 0
 }
 
-func (fs *SopsFS) Opendir(path string) (int, uint64) {
-	log.Printf("[Opendir] path=%s", path)
+// fillEntry lists name in dir with the attributes Getattr reports for it,
+// since with readdir-plus WinFsp takes them as final and never calls Getattr.
+// A file that cannot be sized is listed with size 0 rather than left out.
+func (fs *SopsFS) fillEntry(fill func(name string, stat *fuse.Stat_t, ofst int64) bool, dir, name string) {
+	var stat fuse.Stat_t
+	if errc := fs.Getattr(strings.TrimSuffix(dir, "/")+"/"+name, &stat, 0); errc != 0 {
+		stat.Mode = fuse.S_IFREG | 0444
+	}
+	fill(name, &stat, 0)
+}
 
-	if path == "/" || path == "/secrets" {
-		return 0, 0
+// fillRenderSiblings lists the virtual documents rendering the directory name,
+// skipping any that a real key in parent already uses
+func fillRenderSiblings(entry func(name string), name string, parent interface{}) {
+	for _, r := range renderSuffixes {
+		if _, taken := childNode(parent, name+r.suffix); taken {
+			continue
+		}
+		entry(name + r.suffix)
 	}
+}
 
-	if !strings.HasPrefix(path, "/secrets/") {
-		return -2, 0 // ENOENT
+func (fs *SopsFS) Opendir(path string) (int, uint64) {
+	fsLog.Debug("Opendir", "path", path)
+
+	if path == "/" {
+		return 0, 0
 	}
 
-	keyPath := parseSopsKeyPath(path)
-	if keyPath == nil {
-		return -2, 0 // ENOENT
+	if name, ok := fs.templateName(path); ok {
+		if name != "" {
+			return -20, 0 // ENOTDIR
+		}
+		return 0, 0
 	}
 
-	node, exists := fs.navigateToPath(keyPath)
+	node, exists := fs.lookup(path)
 	if !exists {
 		return -2, 0 // ENOENT
 	}
 
-	if _, isMap := node.(map[string]interface{}); !isMap {
+	if !node.isDir() {
 		return -20, 0 // ENOTDIR
 	}
 
@@ -306,14 +603,16 @@ func (fs *SopsFS) Opendir(path string) (int, uint64) {
 }
 
 func (fs *SopsFS) Releasedir(path string, fh uint64) int {
-	log.Printf("[Releasedir] path=%s fh=%d", path, fh)
+	fsLog.Debug("Releasedir", "path", path, "fh", fh)
 	return 0
 }
 
-func parseSopsKeyPath(filePath string) []string {
+// parseSopsKeyPath splits a FUSE path into the mount name of the secrets file
+// and the key path inside it; the key path is empty for the file's directory
+func parseSopsKeyPath(filePath string) (string, []string) {
 	parts := strings.Split(strings.TrimPrefix(filePath, "/"), "/")
-	if len(parts) < 2 || parts[0] != "secrets" {
-		return nil
+	if parts[0] == "" {
+		return "", nil
 	}
 
 	keys := parts[1:]
@@ -321,65 +620,132 @@ func parseSopsKeyPath(filePath string) []string {
 		keys[i] = strings.TrimSuffix(k, ".yaml")
 		keys[i] = strings.TrimSuffix(keys[i], ".txt")
 	}
-	return keys
+	return parts[0], keys
 }
 
+// readSecret returns a heap copy of the value at path, for callers that need
+// a string such as template rendering. Prefer withSecret.
 func (fs *SopsFS) readSecret(path string) (string, error) {
-	keyPath := parseSopsKeyPath(path)
-	if keyPath == nil {
-		return "", ErrNotFound
+	var secret string
+	_, err := fs.withSecret(path, func(b []byte) { secret = string(b) })
+	return secret, err
+}
+
+// withSecret calls fn with the plaintext of the file at path, from the cache
+// or freshly decrypted, and reports whether it came from the cache. The slice
+// lives in a locked buffer that may be wiped as soon as fn returns, so fn must
+// copy what it needs.
+func (fs *SopsFS) withSecret(path string, fn func(secret []byte)) (bool, error) {
+	node, ok := fs.lookup(path)
+	if !ok || node.isDir() {
+		return false, ErrNotFound
 	}
+	sf := node.file
 
 	if fs.sopsClient == nil {
-		return "", ErrInternal
+		return false, ErrInternal
 	}
 
-	fs.mu.RLock()
-	if cached, ok := fs.secretsCache[path]; ok {
-		if time.Since(cached.timestamp) < secretCacheTTL {
-			fs.mu.RUnlock()
-			log.Printf("[ReadSecret] Cache HIT for %s", path)
-			return cached.value, nil
-		}
+	sf.mu.RLock()
+	if cached, ok := sf.cache[path]; ok && time.Since(cached.timestamp) < cached.ttl {
+		fn(cached.value.Bytes())
+		sf.mu.RUnlock()
+		cacheLog.Debug("Cache hit", "path", path)
+		return true, nil
 	}
-	fs.mu.RUnlock()
-
-	log.Printf("[ReadSecret] Cache MISS for %s, decrypting...", path)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	sf.mu.RUnlock()
 
-	secret, err := fs.sopsClient.DecryptKey(ctx, fs.secretsPath, keyPath)
+	cacheLog.Debug("Cache miss, decrypting", "path", path)
+	plain, err := fs.decryptSecret(node, path)
 	if err != nil {
-		return "", err
+		return false, err
 	}
+	buf := newSecretBuffer(plain)
+	clear(plain)
 
-	fs.mu.Lock()
-	fs.secretsCache[path] = cachedSecret{
-		value:     secret,
+	ttl := fs.secretTTL(node)
+	if ttl == 0 {
+		cacheLog.Debug("Not caching (TTL 0)", "path", path)
+		fn(buf.Bytes())
+		buf.wipe()
+		return false, nil
+	}
+
+	sf.mu.Lock()
+	sf.evictLocked(path)
+	sf.cache[path] = cachedSecret{
+		value:     buf,
 		timestamp: time.Now(),
+		keyPath:   strings.Join(node.keyPath, "/"),
+		subtree:   node.render != "",
+		ttl:       ttl,
 	}
-	fs.mu.Unlock()
+	fn(buf.Bytes())
+	sf.mu.Unlock()
 
-	log.Printf("[ReadSecret] Cached decrypted secret for %s", path)
-	return secret, nil
+	cacheLog.Debug("Cached decrypted value", "path", path, "ttl", ttl.String())
+	return false, nil
 }
 
-// findTestKeyPath finds a suitable key path for self-testing by looking for the first leaf value
-func findTestKeyPath(secretsPath string) []string {
-	data, err := os.ReadFile(secretsPath)
-	if err != nil {
-		log.Printf("[SelfTest] Cannot read secrets file for test path discovery: %v", err)
-		return nil
+// decryptSecret decrypts, renders and transforms the value of node into a
+// fresh slice the caller owns and should clear
+func (fs *SopsFS) decryptSecret(node fsNode, path string) ([]byte, error) {
+	sf := node.file
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var secret string
+	if node.render != "" {
+		subtree, err := fs.sopsClient.DecryptSubtree(ctx, sf.path, sf.format, node.keyPath)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := renderDocument(node.render, subtree)
+		if err != nil {
+			return nil, fmt.Errorf("render %s: %w", path, err)
+		}
+		if node.transform == nil {
+			return doc, nil
+		}
+		secret = string(doc)
+		clear(doc)
+	} else {
+		var err error
+		secret, err = fs.sopsClient.DecryptKey(ctx, sf.path, sf.format, node.keyPath)
+		if err != nil {
+			return nil, err
+		}
 	}
+	if node.transform != nil {
+		var err error
+		secret, err = node.transform.apply(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", strings.TrimPrefix(node.transform.suffix, "."), path, err)
+		}
+	}
+	return []byte(secret), nil
+}
 
-	var root map[string]interface{}
-	if err := yaml.Unmarshal(data, &root); err != nil {
-		log.Printf("[SelfTest] Cannot parse secrets file for test path discovery: %v", err)
-		return nil
+// secretTTL applies the cache policy to a resolved node. Policy paths start
+// with the mount name; a binary file is just its mount name.
+func (fs *SopsFS) secretTTL(node fsNode) time.Duration {
+	keyPath := node.file.name
+	if !node.file.binary && len(node.keyPath) > 0 {
+		keyPath += "/" + strings.Join(node.keyPath, "/")
+	}
+	if node.render != "" {
+		return fs.cachePolicy.subtreeTTL(keyPath, node.value)
 	}
+	return fs.cachePolicy.ttl(keyPath)
+}
 
-	// Remove sops metadata
-	delete(root, "sops")
+// findTestKeyPath finds a suitable key path for self-testing by looking for the first leaf value
+func findTestKeyPath(sc *SopsClient, spec secretsSpec) []string {
+	root, err := sc.GetSecretsStructure(spec.path, spec.format)
+	if err != nil {
+		cliLog.Error("Cannot load secrets file for test path discovery", "file", spec.path, "error", err)
+		return nil
+	}
 
 	// Find the first leaf path
 	var path []string
@@ -387,139 +753,198 @@ func findTestKeyPath(secretsPath string) []string {
 		return path
 	}
 
-	log.Printf("[SelfTest] Could not find any leaf values in secrets structure")
+	cliLog.Error("Could not find any leaf values in secrets structure", "file", spec.path)
 	return nil
 }
 
 // findLeafPath recursively finds the first leaf path in the structure
 func findLeafPath(node interface{}, currentPath *[]string) bool {
-	switch v := node.(type) {
-	case map[string]interface{}:
-		for key, value := range v {
-			*currentPath = append(*currentPath, key)
-			if findLeafPath(value, currentPath) {
-				return true
-			}
-			*currentPath = (*currentPath)[:len(*currentPath)-1]
-		}
-		return false
-	default:
+	if !isDirNode(node) {
 		// Found a leaf
 		return true
 	}
-}
 
-func main() {
-	keyserviceAddr := flag.String("keyservice", "sops-keyservice.lan:5000", "SOPS keyservice address (tcp://host:port or host:port)")
-	secretsPath := flag.String("secrets", "secrets.yaml", "Path to SOPS-encrypted YAML file")
-	mountPoint := flag.String("mount", "/run", "Mount point")
-	selfTest := flag.Bool("selftest", false, "Run a single decrypt self-test and exit")
-	ksSmoke := flag.Bool("ks-smoketest", false, "Ping keyservice via gRPC (expects error) and exit")
-	showVersion := flag.Bool("version", false, "Print version and exit")
-	flag.Parse()
-
-	// Handle --version early
-	if *showVersion {
-		fmt.Printf("win-secrets %s (commit %s, date %s)\n", Version, Commit, Date)
-		return
-	}
-
-	if *ksSmoke {
-		if err := configureSOPSKeyservice(*keyserviceAddr); err != nil {
-			log.Fatalf("Failed to configure SOPS keyservice: %v", err)
+	found := false
+	childEntries(node, func(key string, value interface{}) {
+		if found {
+			return
+		}
+		*currentPath = append(*currentPath, key)
+		if findLeafPath(value, currentPath) {
+			found = true
+			return
 		}
+		*currentPath = (*currentPath)[:len(*currentPath)-1]
+	})
+	return found
+}
 
-		endpoint := os.Getenv("SOPS_KEYSERVICE")
-		target := strings.TrimPrefix(endpoint, "tcp://")
+// mountFlags are the flags of the default mode, which mounts the filesystem
+// and optionally serves the HTTP API
+type mountFlags struct {
+	client         clientFlags
+	mountPoint     string
+	serveHTTP      string
+	httpTokenFile  string
+	reloadInterval time.Duration
+	offlineGrace   time.Duration
+	templatesDir   string
+	sizeMode       string
+	cacheTTLs      cachePolicy
+	audit          auditFlags
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
+func (m *mountFlags) register(fs *flag.FlagSet) {
+	m.client.register(fs)
+	fs.StringVar(&m.mountPoint, "mount", "/run", "Mount point (empty to serve only -serve-http)")
+	fs.StringVar(&m.serveHTTP, "serve-http", "", "Serve the HTTP API on a unix socket (unix:///path/api.sock) or loopback address (127.0.0.1:8200), alongside or instead of the mount")
+	fs.StringVar(&m.httpTokenFile, "http-token-file", "", "File holding the HTTP API bearer token, created with a random token if missing (default win-secrets/http-token in the user config directory)")
+	fs.DurationVar(&m.reloadInterval, "reload-interval", 2*time.Second, "How often to poll the secrets file for changes (0 disables hot reload)")
+	fs.DurationVar(&m.offlineGrace, "offline-grace", 0, "Keep unwrapped data keys sealed in memory this long so reads keep working while no keyservice is reachable (0 disables)")
+	fs.StringVar(&m.templatesDir, "templates", "", "Directory of text/template files rendered under /templates (disabled if empty)")
+	fs.StringVar(&m.sizeMode, "size-mode", string(sizeFromEnvelope), "How Getattr sizes secret files: envelope (from ciphertext, no decrypt) or decrypt")
+	fs.Var(&m.cacheTTLs, "cache-ttl", "Cache TTL for decrypted values matching a key-path glob, as glob=ttl (e.g. prod/**=0 never caches); first match wins, repeatable (default 5m for all)")
+	m.audit.register(fs)
+}
 
-		cc, err := grpc.DialContext(ctx, target, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-		if err != nil {
-			log.Fatalf("[Smoke] Dial: %v", err)
+// validate checks the flags of the mount mode, including the shared ones
+func (m *mountFlags) validate() (keyserviceMode, sizeStrategy, error) {
+	ksMode, err := m.client.validate()
+	if err != nil {
+		return "", "", err
+	}
+	for _, spec := range m.client.secrets {
+		if m.templatesDir != "" && spec.name == templatesRoot {
+			return "", "", fmt.Errorf("invalid -secrets: %q is reserved for -templates", templatesRoot)
 		}
-		defer cc.Close()
-
-		// Test gRPC connectivity by making a call to a non-existent service
-		// This will fail with "unimplemented" if the server is responding
-		err = cc.Invoke(ctx, "/test.TestService/TestMethod", nil, nil)
-		if err == nil {
-			log.Fatalf("[Smoke] unexpected success - server should not implement test service")
+		if m.offlineGrace > 0 && spec.name == graceControlFile {
+			return "", "", fmt.Errorf("invalid -secrets: %q is reserved for -offline-grace", graceControlFile)
 		}
+	}
 
-		// Check if it's an "unimplemented" error (good) or connection error (bad)
-		if strings.Contains(err.Error(), "unimplemented") || strings.Contains(err.Error(), "Unimplemented") {
-			log.Printf("[Smoke] OK - server responded with unimplemented (gRPC server is running)")
-		} else {
-			log.Fatalf("[Smoke] FAIL - unexpected error: %v", err)
-		}
-		return
+	if m.mountPoint == "" && m.serveHTTP == "" {
+		return "", "", errors.New("nothing to serve: set -mount or -serve-http")
 	}
 
-	if *selfTest {
-		if err := configureSOPSKeyservice(*keyserviceAddr); err != nil {
-			log.Fatalf("Failed to configure SOPS keyservice: %v", err)
-		}
-		LogSopsRecipients(*secretsPath)
-		sc, err := NewSopsClient(*keyserviceAddr)
-		if err != nil {
-			log.Fatalf("Failed to create SOPS client: %v", err)
-		}
-		defer sc.Close()
+	sizeStrat, err := parseSizeStrategy(m.sizeMode)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid -size-mode: %w", err)
+	}
+	if err := m.audit.validate(); err != nil {
+		return "", "", err
+	}
+	return ksMode, sizeStrat, nil
+}
 
-		// Try to find a test key path - for now, use a hardcoded path or find first leaf
-		testPath := findTestKeyPath(*secretsPath)
-		if testPath == nil {
-			log.Fatalf("[SelfTest] Could not find a suitable test key path")
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := findSubcommand(os.Args[1]); ok {
+			os.Exit(cmd.run(os.Args[2:]))
 		}
+	}
 
-		val, err := sc.DecryptKey(context.Background(), *secretsPath, testPath)
-		if err != nil {
-			log.Fatalf("[SelfTest] FAIL: %v", err)
-		}
-		log.Printf("[SelfTest] OK: %d bytes", len(val))
-		return
+	var m mountFlags
+	m.register(flag.CommandLine)
+	selfTestFlag := flag.Bool("selftest", false, "Same as the selftest command")
+	ksSmoke := flag.Bool("ks-smoketest", false, "Same as the probe command")
+	showVersion := flag.Bool("version", false, "Same as the version command")
+	flag.Parse()
+
+	if *showVersion {
+		os.Exit(runVersion(nil))
+	}
+	client := &m.client
+	if err := client.configure(flag.CommandLine); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	switch {
+	case *selfTestFlag:
+		os.Exit(selfTest(client))
+	case *ksSmoke:
+		os.Exit(probeKeyservices(client))
 	}
 
-	// Remove the error check since we now have a default
-	log.Printf("Starting SOPS Secrets Filesystem Proxy")
-	log.Printf("Keyservice: %s", *keyserviceAddr)
-	log.Printf("Secrets file: %s", *secretsPath)
-	log.Printf("Mount point: %s", *mountPoint)
+	ksMode, sizeStrat, err := m.validate()
+	if err != nil {
+		fatal("Invalid settings", "error", err)
+	}
+	secretsFiles := client.secrets
 
-	if err := configureSOPSKeyservice(*keyserviceAddr); err != nil {
-		log.Fatalf("Failed to configure SOPS keyservice: %v", err)
+	cliLog.Info("Starting SOPS Secrets Filesystem Proxy")
+	cliLog.Info("Keyservice", "endpoints", client.keyserviceAddr, "transport", client.tls.String(), "mode", string(ksMode))
+	for _, spec := range secretsFiles {
+		cliLog.Info("Secrets file", "file", spec.path, "mount", "/"+spec.name)
+	}
+	if m.templatesDir != "" {
+		cliLog.Info("Templates", "dir", m.templatesDir, "mount", "/"+templatesRoot)
+	}
+	if m.mountPoint != "" {
+		cliLog.Info("Mount point", "path", m.mountPoint)
 	}
 
-	sopsClient, err := NewSopsClient(*keyserviceAddr)
+	sopsClient, err := client.newClient()
 	if err != nil {
-		log.Fatalf("Failed to create SOPS client: %v", err)
+		fatal("Failed to configure SOPS keyservice", "error", err)
 	}
 	defer sopsClient.Close()
 
-	fs, err := NewSopsFS(sopsClient, *secretsPath)
+	if m.offlineGrace > 0 {
+		if err := sopsClient.EnableOfflineGrace(m.offlineGrace); err != nil {
+			fatal("Failed to enable offline grace", "error", err)
+		}
+	}
+
+	fs, err := NewSopsFS(sopsClient, secretsFiles, sizeStrat, m.cacheTTLs)
 	if err != nil {
-		log.Fatalf("Failed to create filesystem: %v", err)
+		fatal("Failed to create filesystem", "error", err)
+	}
+	fs.templatesDir = m.templatesDir
+
+	if fs.audit, err = m.audit.open(); err != nil {
+		fatal("Failed to open audit log", "error", err)
+	}
+	defer fs.audit.close()
+
+	if m.reloadInterval > 0 {
+		for _, name := range fs.fileNames {
+			go fs.watchSecretsFile(fs.files[name], m.reloadInterval)
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	if m.serveHTTP != "" {
+		api, err := startAPI(fs, m.serveHTTP, m.httpTokenFile)
+		if err != nil {
+			fatal("Failed to start HTTP API", "error", err)
+		}
+		defer api.Close()
+	}
+
+	if m.mountPoint == "" {
+		<-sigChan
+		cliLog.Info("Received shutdown signal, stopping")
+		fs.wipeSecrets()
+		return
 	}
 
 	host := fuse.NewFileSystemHost(fs)
 	host.SetCapReaddirPlus(true)
 
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
-		log.Println("Received shutdown signal, unmounting...")
+		cliLog.Info("Received shutdown signal, unmounting")
 		host.Unmount()
 	}()
 
-	log.Printf("Mounting filesystem at %s", *mountPoint)
+	cliLog.Info("Mounting filesystem", "path", m.mountPoint)
 
-	ret := host.Mount(*mountPoint, []string{"-o", "volname=SOPS Secrets"})
+	ret := host.Mount(m.mountPoint, []string{"-o", "volname=SOPS Secrets,uid=-1,gid=-1"})
+	fs.wipeSecrets()
 	if !ret {
-		log.Fatal("Mount failed")
+		fatal("Mount failed", "path", m.mountPoint)
 	}
 
-	log.Println("Filesystem unmounted successfully")
+	cliLog.Info("Filesystem unmounted successfully")
 }
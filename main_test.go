@@ -1,43 +1,64 @@
 package main
 
 import (
+	"strings"
 	"testing"
+
+	"github.com/winfsp/cgofuse/fuse"
 )
 
 func TestParseSopsKeyPath(t *testing.T) {
 	tests := []struct {
-		name     string
-		input    string
-		expected []string
+		name         string
+		input        string
+		expectedRoot string
+		expected     []string
 	}{
 		{
-			name:     "simple top-level key",
-			input:    "/secrets/vaultwarden_admin_token",
-			expected: []string{"vaultwarden_admin_token"},
+			name:         "simple top-level key",
+			input:        "/secrets/vaultwarden_admin_token",
+			expectedRoot: "secrets",
+			expected:     []string{"vaultwarden_admin_token"},
+		},
+		{
+			name:         "nested key",
+			input:        "/secrets/postgres/admin_pass",
+			expectedRoot: "secrets",
+			expected:     []string{"postgres", "admin_pass"},
 		},
 		{
-			name:     "nested key",
-			input:    "/secrets/postgres/admin_pass",
-			expected: []string{"postgres", "admin_pass"},
+			name:         "deeply nested key",
+			input:        "/secrets/aws/hosted_zone_id_bogorad_eu",
+			expectedRoot: "secrets",
+			expected:     []string{"aws", "hosted_zone_id_bogorad_eu"},
 		},
 		{
-			name:     "deeply nested key",
-			input:    "/secrets/aws/hosted_zone_id_bogorad_eu",
-			expected: []string{"aws", "hosted_zone_id_bogorad_eu"},
+			name:         "key with .yaml extension",
+			input:        "/secrets/postgres/test_pass.yaml",
+			expectedRoot: "secrets",
+			expected:     []string{"postgres", "test_pass"},
 		},
 		{
-			name:     "key with .yaml extension",
-			input:    "/secrets/postgres/test_pass.yaml",
-			expected: []string{"postgres", "test_pass"},
+			name:         "key with .txt extension",
+			input:        "/secrets/codeium_config.txt",
+			expectedRoot: "secrets",
+			expected:     []string{"codeium_config"},
 		},
 		{
-			name:     "key with .txt extension",
-			input:    "/secrets/codeium_config.txt",
-			expected: []string{"codeium_config"},
+			name:         "key in another mounted file",
+			input:        "/prod/postgres/admin_pass",
+			expectedRoot: "prod",
+			expected:     []string{"postgres", "admin_pass"},
 		},
 		{
-			name:     "invalid path - no secrets prefix",
-			input:    "/other/path",
+			name:         "mounted file directory",
+			input:        "/secrets",
+			expectedRoot: "secrets",
+			expected:     []string{},
+		},
+		{
+			name:     "invalid path - root",
+			input:    "/",
 			expected: nil,
 		},
 		{
@@ -49,7 +70,11 @@ func TestParseSopsKeyPath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := parseSopsKeyPath(tt.input)
+			root, result := parseSopsKeyPath(tt.input)
+
+			if root != tt.expectedRoot {
+				t.Errorf("Expected root %q, got %q", tt.expectedRoot, root)
+			}
 
 			if tt.expected == nil {
 				if result != nil {
@@ -72,4 +97,143 @@ func TestParseSopsKeyPath(t *testing.T) {
 	}
 }
 
+func TestSecretsFlag(t *testing.T) {
+	var f secretsFlag
+	for _, v := range []string{"prod=C:\\secrets\\prod.yaml", "dev=dev.yaml"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if len(f) != 2 || f[0].name != "prod" || f[0].path != "C:\\secrets\\prod.yaml" || f[1].name != "dev" {
+		t.Fatalf("Unexpected specs: %+v", f)
+	}
+
+	if err := f.Set("dev=other.yaml"); err == nil {
+		t.Errorf("Expected duplicate mount name to be rejected")
+	}
+
+	var bare secretsFlag
+	if err := bare.Set("secrets.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if bare[0].name != defaultSecretsName {
+		t.Errorf("Expected bare path to mount as %q, got %q", defaultSecretsName, bare[0].name)
+	}
+
+	// A known store format after the last colon is split off; a drive letter
+	// or any other colon stays part of the path
+	var formats secretsFlag
+	for _, v := range []string{"prod=C:\\secrets\\prod.conf:json", "keytab.dat:binary", "x=C:\\a:b"} {
+		if err := formats.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if formats[0].path != "C:\\secrets\\prod.conf" || formats[0].format != "json" ||
+		formats[1].path != "keytab.dat" || formats[1].format != "binary" ||
+		formats[2].path != "C:\\a:b" || formats[2].format != "" {
+		t.Errorf("Unexpected specs: %+v", formats)
+	}
+	if s := formats.String(); s != "prod=C:\\secrets\\prod.conf:json,secrets=keytab.dat:binary,x=C:\\a:b" {
+		t.Errorf("Unexpected String() %q", s)
+	}
+	c := clientFlags{secrets: formats, format: "yaml", mode: string(keyserviceRemote)}
+	if _, err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.secrets[0].format != "json" || c.secrets[2].format != "yaml" {
+		t.Errorf("Expected -format only for specs without their own, got %+v", c.secrets)
+	}
+
+	for _, v := range []string{"=x.yaml", "a/b=x.yaml", "name=", "..=x.yaml", "name=:json"} {
+		var bad secretsFlag
+		if err := bad.Set(v); err == nil {
+			t.Errorf("Expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestEnvelopeSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		node     interface{}
+		expected int64
+		ok       bool
+	}{
+		{
+			name:     "encrypted string",
+			node:     "ENC[AES256_GCM,data:7lTyyhOcsA==,iv:47q6HVFQQr6w00bGJAQrbSNZO1c058DYHIBqTfKFjjc=,tag:AkCnLydLCx9QdwINOIzdUQ==,type:str]",
+			expected: 7,
+			ok:       true,
+		},
+		{
+			name:     "encrypted empty string",
+			node:     "ENC[AES256_GCM,data:,iv:47q6HVFQQr6w00bGJAQrbSNZO1c058DYHIBqTfKFjjc=,tag:AkCnLydLCx9QdwINOIzdUQ==,type:str]",
+			expected: 0,
+			ok:       true,
+		},
+		{
+			name:     "unencrypted string",
+			node:     "plain-value",
+			expected: 11,
+			ok:       true,
+		},
+		{
+			name: "malformed envelope",
+			node: "ENC[AES256_GCM,data:not base64!,iv:x,tag:y,type:str]",
+		},
+		{
+			name: "unknown cipher",
+			node: "ENC[OTHER,data:AAAA]",
+		},
+		{
+			name: "non-string scalar",
+			node: 42,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, ok := envelopeSize(tt.node)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok=%v, got %v", tt.ok, ok)
+			}
+			if size != tt.expected {
+				t.Errorf("Expected size %d, got %d", tt.expected, size)
+			}
+		})
+	}
+}
+
 // Note: NewSopsFS test requires real keyservice running - skipped in unit tests
+
+// TestReaddirReportsSizes checks that Readdir fills in the same attributes as
+// Getattr, since with readdir-plus WinFsp never asks for them again
+func TestReaddirReportsSizes(t *testing.T) {
+	fs, _ := mountFixture(t, "secrets", "postgres:\n  admin_pass: hunter2\n", nil)
+
+	for dir, want := range map[string]map[string]int64{
+		"/":                 {"secrets.yaml": int64(len("postgres:\n  admin_pass: hunter2\n"))},
+		"/secrets":          {"postgres.env": int64(len("admin_pass=hunter2\n"))},
+		"/secrets/postgres": {"admin_pass": int64(len("hunter2"))},
+	} {
+		listed := map[string]fuse.Stat_t{}
+		fs.Readdir(dir, func(name string, stat *fuse.Stat_t, ofst int64) bool {
+			if stat != nil {
+				listed[name] = *stat
+			}
+			return true
+		}, 0, 0)
+
+		for name, stat := range listed {
+			var got fuse.Stat_t
+			if errc := fs.Getattr(strings.TrimSuffix(dir, "/")+"/"+name, &got, 0); errc != 0 || got != stat {
+				t.Errorf("Expected %s in %s to be listed as Getattr reports it, got %+v and %+v (%d)", name, dir, stat, got, errc)
+			}
+		}
+		for name, size := range want {
+			if stat, ok := listed[name]; !ok || stat.Size != size {
+				t.Errorf("Expected %s in %s listed with size %d, got %d", name, dir, size, stat.Size)
+			}
+		}
+	}
+}
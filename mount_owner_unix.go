@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import "os"
+
+// mountOwner returns the IDs of the mounting user, who owns every file
+func mountOwner() (uid, gid uint32) {
+	return uint32(os.Getuid()), uint32(os.Getgid())
+}
+
+// ownsMount reports whether the caller uid may delete the control file.
+// Without default_permissions FUSE does not check the mode bits itself.
+func (fs *SopsFS) ownsMount(uid uint32) bool {
+	return uid == fs.uid || uid == 0
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+// mountOwner returns -1 for both IDs; the mount passes -o uid=-1,gid=-1, for
+// which WinFsp reports the mounting user as the owner of every file
+func mountOwner() (uid, gid uint32) {
+	return ^uint32(0), ^uint32(0)
+}
+
+// ownsMount reports whether the caller uid may delete the control file.
+// WinFsp checks the mode bits before the call reaches Unlink.
+func (fs *SopsFS) ownsMount(uid uint32) bool {
+	return true
+}
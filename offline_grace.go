@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// graceControlFile is the virtual file at the mount root that shows the offline
+// grace cache; deleting it drops every cached data key and decrypted value
+const graceControlFile = ".offline-grace"
+
+// graceServiceName attributes a decrypt to the offline grace cache in logs
+const graceServiceName = "offline-grace"
+
+// graceKey is the SOPS data key of one file, sealed with the process key
+type graceKey struct {
+	sealed  []byte // nonce followed by the AES-GCM ciphertext
+	expires time.Time
+}
+
+// graceCache keeps unwrapped SOPS data keys in memory for a fixed window so
+// files can still be decrypted while no keyservice is reachable. Keys are
+// sealed with a random key that exists only in this process and are never
+// written to disk.
+type graceCache struct {
+	window time.Duration
+	aead   cipher.AEAD
+
+	mu   sync.Mutex
+	keys map[string]*graceKey // by secrets file path
+}
+
+func newGraceCache(window time.Duration) (*graceCache, error) {
+	processKey := make([]byte, 32)
+	if _, err := rand.Read(processKey); err != nil {
+		return nil, fmt.Errorf("generate process key: %w", err)
+	}
+	block, err := aes.NewCipher(processKey)
+	clear(processKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &graceCache{window: window, aead: aead, keys: make(map[string]*graceKey)}, nil
+}
+
+// store seals the data key of filePath and (re)starts its grace window
+func (g *graceCache) store(filePath string, dataKey []byte) error {
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := g.aead.Seal(nonce, nonce, dataKey, []byte(filePath))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.wipeLocked(filePath)
+	g.keys[filePath] = &graceKey{sealed: sealed, expires: time.Now().Add(g.window)}
+	return nil
+}
+
+// load unseals the data key of filePath if its grace window has not expired.
+// The caller owns the returned slice and should clear it after use.
+func (g *graceCache) load(filePath string) ([]byte, time.Time, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	k, ok := g.keys[filePath]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	if !time.Now().Before(k.expires) {
+		g.wipeLocked(filePath)
+		cacheLog.Info("Offline data key expired", "file", filePath)
+		return nil, time.Time{}, false
+	}
+
+	n := g.aead.NonceSize()
+	dataKey, err := g.aead.Open(nil, k.sealed[:n], k.sealed[n:], []byte(filePath))
+	if err != nil {
+		cacheLog.Error("Cannot unseal offline data key", "file", filePath, "error", err)
+		return nil, time.Time{}, false
+	}
+	return dataKey, k.expires, true
+}
+
+// purgeExpired wipes the keys whose grace window has passed
+func (g *graceCache) purgeExpired() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for path, k := range g.keys {
+		if !now.Before(k.expires) {
+			g.wipeLocked(path)
+			cacheLog.Info("Offline data key expired", "file", path)
+		}
+	}
+}
+
+// drop wipes every key and returns how many there were
+func (g *graceCache) drop() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	n := len(g.keys)
+	for path := range g.keys {
+		g.wipeLocked(path)
+	}
+	return n
+}
+
+func (g *graceCache) wipeLocked(filePath string) {
+	if k, ok := g.keys[filePath]; ok {
+		clear(k.sealed)
+		delete(g.keys, filePath)
+	}
+}
+
+// status describes the cache for the control file, without any key material
+func (g *graceCache) status() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	paths := make([]string, 0, len(g.keys))
+	for path := range g.keys {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "window: %s\n", g.window)
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s\texpires %s\n", path, g.keys[path].expires.Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// EnableOfflineGrace keeps each unwrapped data key for window so reads keep
+// working while no keyservice is reachable
+func (c *SopsClient) EnableOfflineGrace(window time.Duration) error {
+	g, err := newGraceCache(window)
+	if err != nil {
+		return err
+	}
+	c.grace = g
+	cacheLog.Info("Offline grace enabled: data keys are kept sealed in memory", "window", window.String())
+	return nil
+}
+
+// DropOfflineGrace wipes the cached data keys and every decrypted tree, so
+// nothing can be read again until a keyservice unwraps the keys
+func (c *SopsClient) DropOfflineGrace() int {
+	c.WipeTrees()
+
+	if c.grace == nil {
+		return 0
+	}
+	return c.grace.drop()
+}
+
+// isGraceControl reports whether path is the offline grace control file,
+// which exists only while offline grace is enabled
+func (fs *SopsFS) isGraceControl(path string) bool {
+	return path == "/"+graceControlFile && fs.sopsClient != nil && fs.sopsClient.grace != nil
+}
+
+// Unlink implements deleting the offline grace control file, which drops the
+// cached data keys along with every decrypted value. Only the owner of the
+// mount may delete it, and nothing else can be deleted.
+func (fs *SopsFS) Unlink(path string) int {
+	fsLog.Debug("Unlink", "path", path)
+
+	if !fs.isGraceControl(path) {
+		return -30 // EROFS
+	}
+	if uid, _, _ := fuseContext(); !fs.ownsMount(uid) {
+		return -13 // EACCES
+	}
+
+	n := fs.wipeSecrets()
+	cacheLog.Info("Dropped offline data keys and all decrypted values", "data_keys", n)
+	return 0
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func TestGraceCacheSealsAndExpires(t *testing.T) {
+	g, err := newGraceCache(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := bytes.Repeat([]byte{0x42}, 32)
+	if err := g.store("secrets.yaml", dataKey); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(g.keys["secrets.yaml"].sealed, dataKey) {
+		t.Errorf("Expected the data key to be sealed")
+	}
+
+	got, _, ok := g.load("secrets.yaml")
+	if !ok || !bytes.Equal(got, dataKey) {
+		t.Errorf("Expected to unseal the data key, got %x", got)
+	}
+	if _, _, ok := g.load("other.yaml"); ok {
+		t.Errorf("Expected no key for another file")
+	}
+
+	g.keys["secrets.yaml"].expires = time.Now().Add(-time.Second)
+	if _, _, ok := g.load("secrets.yaml"); ok {
+		t.Errorf("Expected an expired key not to be used")
+	}
+	if len(g.keys) != 0 {
+		t.Errorf("Expected the expired key to be wiped")
+	}
+}
+
+func TestOfflineGraceKeepsReadsWorking(t *testing.T) {
+	fs, ks := mountFixture(t, "secrets", "postgres:\n  admin_pass: hunter2\n", nil)
+	c, path := fs.sopsClient, fs.files["secrets"].path
+
+	// A remote endpoint that is never connected, answered by the fake
+	conn, err := grpc.NewClient("passthrough:///offline", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c.services = []*trackedKeyservice{newTrackedKeyservice("tcp://ks1:5000", ks, conn)}
+	if err := c.EnableOfflineGrace(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() (string, int) {
+		buff := make([]byte, 64)
+		n := fs.Read("/secrets/postgres/admin_pass", buff, 0, 0)
+		return string(buff[:max(n, 0)]), n
+	}
+
+	if got, _ := read(); got != "hunter2" {
+		t.Fatalf("Expected hunter2 while online, got %q", got)
+	}
+
+	// Go offline: drop every plaintext copy but keep the sealed data key
+	ks.err = status.Error(codes.Unavailable, "no route to host")
+	c.treeMu.Lock()
+	c.wipeTreeLocked(path)
+	c.treeMu.Unlock()
+	clear(fs.files["secrets"].cache)
+
+	if got, n := read(); got != "hunter2" {
+		t.Fatalf("Expected the offline data key to decrypt, got %q (%d)", got, n)
+	}
+	if servedBy := c.ServedBy(path); !reflect.DeepEqual(servedBy, []string{graceServiceName}) {
+		t.Errorf("Expected the decrypt to be attributed to the grace cache, got %v", servedBy)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/"+graceControlFile, &stat, 0); errc != 0 {
+		t.Fatalf("Getattr control file returned %d", errc)
+	}
+	buff := make([]byte, 4096)
+	n := fs.Read("/"+graceControlFile, buff, 0, 0)
+	if status := string(buff[:max(n, 0)]); !strings.Contains(status, path) || strings.Contains(status, "hunter2") {
+		t.Errorf("Unexpected control file content %q", status)
+	}
+
+	if errc := fs.Unlink("/secrets/postgres/admin_pass"); errc != -30 {
+		t.Errorf("Expected EROFS deleting a secret, got %d", errc)
+	}
+	// Only the owner of the mount may delete the control file
+	fs.uid, fs.gid = 1000, 1000
+	if runtime.GOOS != "windows" {
+		fakeFuseContext(t, 1001, 1001, 4242)
+		if errc := fs.Unlink("/" + graceControlFile); errc != -13 {
+			t.Errorf("Expected EACCES deleting the control file as another user, got %d", errc)
+		}
+	}
+	fakeFuseContext(t, 1000, 1000, 4242)
+	if errc := fs.Unlink("/" + graceControlFile); errc != 0 {
+		t.Fatalf("Unlink control file returned %d", errc)
+	}
+	if _, n := read(); n != -11 {
+		t.Errorf("Expected EAGAIN after dropping the grace cache while offline, got %d", n)
+	}
+}
+
+func TestOfflineGraceNotUsedWhileConnected(t *testing.T) {
+	dataKey := make([]byte, 32)
+	path := writeEncryptedFixture(t, "token: abc\n", dataKey)
+
+	// The local client counts as connected: its refusal must stand
+	ks := &fakeKeyservice{dataKey: dataKey}
+	c := &SopsClient{
+		services: []*trackedKeyservice{newTrackedKeyservice(localKeyserviceName, ks, nil)},
+		trees:    make(map[string]*decryptedTree),
+	}
+	if err := c.EnableOfflineGrace(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DecryptKey(context.Background(), path, "", []string{"token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ks.err = status.Error(codes.PermissionDenied, "revoked")
+	c.treeMu.Lock()
+	c.wipeTreeLocked(path)
+	c.treeMu.Unlock()
+	if _, err := c.DecryptKey(context.Background(), path, "", []string{"token"}); err == nil {
+		t.Errorf("Expected a refusal from a connected key service not to fall back to the grace cache")
+	}
+}
+
+func TestDropOfflineGraceThroughAPI(t *testing.T) {
+	fs, _ := mountFixture(t, "secrets", "token: abc\n", nil)
+	c := fs.sopsClient
+	srv := httptest.NewServer(newSecretsAPI(fs, "t0k3n"))
+	defer srv.Close()
+	do := func(method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer t0k3n")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, _ := do("DELETE", "/v1/offline-grace"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without -offline-grace, got %d", code)
+	}
+
+	if err := c.EnableOfflineGrace(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	uid, gid := mountOwner()
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/"+graceControlFile, &stat, 0); errc != 0 || stat.Mode != fuse.S_IFREG|0400 || stat.Uid != uid || stat.Gid != gid {
+		t.Errorf("Expected a control file owned by %d:%d only, got errc=%d mode=%o owner %d:%d", uid, gid, errc, stat.Mode, stat.Uid, stat.Gid)
+	}
+	fs.Readdir("/", func(name string, st *fuse.Stat_t, ofst int64) bool {
+		if name == graceControlFile && (st.Mode != fuse.S_IFREG|0400 || st.Uid != uid || st.Gid != gid) {
+			t.Errorf("Expected Readdir to list the control file owned by %d:%d only, got mode=%o owner %d:%d", uid, gid, st.Mode, st.Uid, st.Gid)
+		}
+		return true
+	}, 0, 0)
+	if errc := fs.Getattr("/", &stat, 0); errc != 0 || stat.Mode != fuse.S_IFDIR|0755 || stat.Uid != uid {
+		t.Errorf("Expected a root directory writable by %d only, got errc=%d mode=%o owner %d", uid, errc, stat.Mode, stat.Uid)
+	}
+	if _, err := fs.readSecret("/secrets/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flush keeps the data keys
+	if code, _ := do("POST", "/v1/cache/flush"); code != http.StatusOK || len(c.grace.keys) != 1 {
+		t.Fatalf("Expected flush to keep the data key, got %d with %d keys", code, len(c.grace.keys))
+	}
+	if _, err := fs.readSecret("/secrets/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := do("DELETE", "/v1/offline-grace")
+	if code != http.StatusOK || body != "{\n  \"dropped\": 1\n}\n" {
+		t.Errorf("Expected one dropped data key, got %d %q", code, body)
+	}
+	if len(c.grace.keys) != 0 || len(c.trees) != 0 || len(fs.files["secrets"].cache) != 0 {
+		t.Errorf("Expected no data keys, trees or values, got %d, %d and %d", len(c.grace.keys), len(c.trees), len(fs.files["secrets"].cache))
+	}
+}
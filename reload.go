@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileFingerprint is the cheap stat-based identity of the secrets file, used
+// to skip hashing on polls where nothing could have changed
+type fileFingerprint struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchSecretsFile polls the secrets file and reloads the structure whenever
+// its content changes, e.g. after `sops edit` or a dotfiles `git pull`
+func (fs *SopsFS) watchSecretsFile(sf *secretsFile, interval time.Duration) {
+	var lastPrint fileFingerprint
+	var lastHash [sha256.Size]byte
+
+	if fi, err := os.Stat(sf.path); err == nil {
+		lastPrint = fileFingerprint{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	if data, err := os.ReadFile(sf.path); err == nil {
+		lastHash = sha256.Sum256(data)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	sopsLog.Info("Watching secrets file", "file", sf.path, "interval", interval.String())
+	for range ticker.C {
+		fi, err := os.Stat(sf.path)
+		if err != nil {
+			// Editors often replace the file via rename; try again next tick
+			continue
+		}
+		fp := fileFingerprint{modTime: fi.ModTime(), size: fi.Size()}
+		if fp == lastPrint {
+			continue
+		}
+
+		data, err := os.ReadFile(sf.path)
+		if err != nil {
+			sopsLog.Warn("Cannot read secrets file", "file", sf.path, "error", err)
+			continue
+		}
+		lastPrint = fp
+
+		hash := sha256.Sum256(data)
+		if hash == lastHash {
+			continue
+		}
+
+		sopsLog.Info("Secrets file changed on disk, reloading structure", "file", sf.path)
+		if err := fs.refreshSecretsStructure(sf); err != nil {
+			// Keep serving the previous structure; a half-written file will be
+			// picked up again on the next change
+			sopsLog.Error("Reload failed, keeping previous structure", "file", sf.path, "error", err)
+			continue
+		}
+		lastHash = hash
+	}
+}
+
+// logAndInvalidateChangesLocked logs which keys were added, removed or changed
+// between two structures and wipes cached values for removed or changed keys.
+// Caller must hold sf.mu for writing.
+func (sf *secretsFile) logAndInvalidateChangesLocked(previous, current map[string]interface{}) {
+	added, removed, changed := diffSecretsTrees(previous, current)
+	for _, k := range added {
+		sopsLog.Info("Key added", "mount", sf.name, "key_path", k)
+	}
+	for _, k := range removed {
+		sopsLog.Info("Key removed", "mount", sf.name, "key_path", k)
+	}
+	for _, k := range changed {
+		sopsLog.Info("Key changed", "mount", sf.name, "key_path", k)
+	}
+
+	// Added keys matter too: they change every document rendering a parent
+	affected := make([]string, 0, len(added)+len(removed)+len(changed))
+	affected = append(affected, added...)
+	affected = append(affected, removed...)
+	affected = append(affected, changed...)
+
+	for path, cached := range sf.cache {
+		if cacheEntryAffected(cached, affected) {
+			sf.evictLocked(path)
+			cacheLog.Debug("Wiped cache entry after reload", "path", path)
+		}
+	}
+}
+
+// cacheEntryAffected reports whether a cached value depends on any of the
+// given leaf paths: a leaf on its own key, a rendered document on its subtree
+func cacheEntryAffected(cached cachedSecret, leaves []string) bool {
+	for _, leaf := range leaves {
+		if leaf == cached.keyPath {
+			return true
+		}
+		if cached.subtree && (cached.keyPath == "" || strings.HasPrefix(leaf, cached.keyPath+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffSecretsTrees compares two encrypted structures leaf by leaf. SOPS stores
+// a fresh IV for every re-encrypted value, so a differing envelope is treated
+// as a changed key. Paths are returned sorted and joined with "/".
+func diffSecretsTrees(previous, current map[string]interface{}) (added, removed, changed []string) {
+	oldLeaves := make(map[string]interface{})
+	newLeaves := make(map[string]interface{})
+	collectLeaves(previous, "", oldLeaves)
+	collectLeaves(current, "", newLeaves)
+
+	for k, v := range newLeaves {
+		old, ok := oldLeaves[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !reflect.DeepEqual(old, v):
+			changed = append(changed, k)
+		}
+	}
+	for k := range oldLeaves {
+		if _, ok := newLeaves[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func collectLeaves(node interface{}, prefix string, out map[string]interface{}) {
+	if !isDirNode(node) {
+		out[prefix] = node
+		return
+	}
+	childEntries(node, func(k string, v interface{}) {
+		p := k
+		if prefix != "" {
+			p = prefix + "/" + k
+		}
+		collectLeaves(v, p, out)
+	})
+}
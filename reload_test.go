@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffSecretsTrees(t *testing.T) {
+	previous := map[string]interface{}{
+		"postgres": map[string]interface{}{
+			"admin_pass": "ENC[a]",
+			"test_pass":  "ENC[b]",
+		},
+		"dns":   []interface{}{"ENC[c]", "ENC[d]"},
+		"token": "ENC[e]",
+	}
+	current := map[string]interface{}{
+		"postgres": map[string]interface{}{
+			"admin_pass": "ENC[a2]",
+			"user":       "ENC[f]",
+		},
+		"dns":   []interface{}{"ENC[c]", "ENC[d]"},
+		"token": "ENC[e]",
+	}
+
+	added, removed, changed := diffSecretsTrees(previous, current)
+
+	if !reflect.DeepEqual(added, []string{"postgres/user"}) {
+		t.Errorf("added = %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"postgres/test_pass"}) {
+		t.Errorf("removed = %v", removed)
+	}
+	if !reflect.DeepEqual(changed, []string{"postgres/admin_pass"}) {
+		t.Errorf("changed = %v", changed)
+	}
+}
+
+func TestRefreshSecretsStructureInvalidatesChangedKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(sopsFixture(content)), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("postgres:\n  admin_pass: ENC[a]\n  test_pass: ENC[b]\ntoken: ENC[c]\n")
+	fs := &SopsFS{sopsClient: &SopsClient{}}
+	sf := newSecretsFile(secretsSpec{name: "secrets", path: path})
+	if err := fs.refreshSecretsStructure(sf); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := newSecretBuffer([]byte("old"))
+	sf.cache["/secrets/postgres/admin_pass"] = cachedSecret{value: old, timestamp: now, keyPath: "postgres/admin_pass"}
+	sf.cache["/secrets/postgres/test_pass.txt"] = cachedSecret{value: newSecretBuffer([]byte("gone")), timestamp: now, keyPath: "postgres/test_pass"}
+	sf.cache["/secrets/postgres.json"] = cachedSecret{value: newSecretBuffer([]byte("{}")), timestamp: now, keyPath: "postgres", subtree: true}
+	sf.cache["/secrets/token"] = cachedSecret{value: newSecretBuffer([]byte("same")), timestamp: now, keyPath: "token"}
+
+	write("postgres:\n  admin_pass: ENC[a2]\ntoken: ENC[c]\n")
+	if err := fs.refreshSecretsStructure(sf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := sf.cache["/secrets/postgres/admin_pass"]; ok {
+		t.Errorf("Expected changed key to be invalidated")
+	}
+	if old.Bytes() != nil {
+		t.Errorf("Expected invalidated value to be wiped")
+	}
+	if _, ok := sf.cache["/secrets/postgres/test_pass.txt"]; ok {
+		t.Errorf("Expected removed key to be invalidated")
+	}
+	if _, ok := sf.cache["/secrets/postgres.json"]; ok {
+		t.Errorf("Expected document rendering a changed subtree to be invalidated")
+	}
+	if _, ok := sf.cache["/secrets/token"]; !ok {
+		t.Errorf("Expected unchanged key to stay cached")
+	}
+	if _, ok := fs.navigateToPath(sf, []string{"postgres", "test_pass"}); ok {
+		t.Errorf("Expected removed key to disappear from the tree")
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the virtual documents that render a whole decrypted subtree
+const (
+	renderYAML = "yaml"
+	renderJSON = "json"
+	renderEnv  = "env"
+)
+
+// renderSuffixes maps the file suffix of a virtual document to its format, in
+// the order the siblings are listed
+var renderSuffixes = []struct {
+	suffix string
+	format string
+}{
+	{".yaml", renderYAML},
+	{".json", renderJSON},
+	{".env", renderEnv},
+}
+
+// splitRenderSuffix strips a document suffix from the last element of a FUSE
+// path, returning the format it selects or "" if there is none
+func splitRenderSuffix(filePath string) (string, string) {
+	ext := path.Ext(filePath)
+	for _, r := range renderSuffixes {
+		if ext == r.suffix && len(path.Base(filePath)) > len(ext) {
+			return strings.TrimSuffix(filePath, ext), r.format
+		}
+	}
+	return filePath, ""
+}
+
+// encodeValue renders a decrypted value as file content. Scalars use the text
+// SOPS encrypted for them (so sizes derived from the envelope stay exact),
+// spelled the way YAML writes them: true/false, plain decimal floats, RFC 3339
+// timestamps and an empty file for null. Maps and sequences become YAML.
+func encodeValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return formatFloat(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case map[string]interface{}, []interface{}:
+		doc, err := renderDocument(renderYAML, v)
+		return string(doc), err
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+// formatFloat writes a float without exponent, as SOPS stores it, using the
+// YAML spellings for infinities and NaN
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return ".inf"
+	case math.IsInf(f, -1):
+		return "-.inf"
+	case math.IsNaN(f):
+		return ".nan"
+	default:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+}
+
+// yamlNode builds the YAML node for a decrypted value with map keys sorted and
+// scalars spelled as encodeValue does, so documents and leaf files agree
+func yamlNode(v interface{}) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child, err := yamlNode(v[k])
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, child)
+		}
+		return n, nil
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			child, err := yamlNode(item)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, child)
+		}
+		return n, nil
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v}, nil
+	case []byte:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(v)}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}, nil
+	case float64:
+		s := formatFloat(v)
+		if !strings.ContainsAny(s, ".eEn") {
+			// Keep whole floats from reading back as integers
+			s += ".0"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: s}, nil
+	case time.Time:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!timestamp", Value: v.Format(time.RFC3339Nano)}, nil
+	case int, int64, uint64:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprint(v)}, nil
+	default:
+		s, err := encodeValue(v)
+		if err != nil {
+			return nil, err
+		}
+		n := &yaml.Node{}
+		n.SetString(s)
+		return n, nil
+	}
+}
+
+// renderDocument renders a decrypted subtree as a YAML, JSON or dotenv document
+func renderDocument(format string, node interface{}) ([]byte, error) {
+	switch format {
+	case renderYAML:
+		doc, err := yamlNode(node)
+		if err != nil {
+			return nil, err
+		}
+		var b bytes.Buffer
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+		if err := enc.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case renderJSON:
+		out, err := json.MarshalIndent(node, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	case renderEnv:
+		return renderEnvDocument(node)
+	default:
+		return nil, fmt.Errorf("unknown document format %q", format)
+	}
+}
+
+// renderEnvDocument flattens a subtree into sorted KEY=value lines. Nested keys
+// and sequence indexes are joined with "_" and anything that is not valid in an
+// environment variable name becomes "_".
+func renderEnvDocument(node interface{}) ([]byte, error) {
+	vars := make(map[string]string)
+	if err := flattenEnv(node, "", vars); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(quoteEnvValue(vars[name]))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String()), nil
+}
+
+func flattenEnv(node interface{}, prefix string, out map[string]string) error {
+	if !isDirNode(node) {
+		if prefix == "" {
+			return nil
+		}
+		v, err := encodeValue(node)
+		out[prefix] = v
+		return err
+	}
+
+	var err error
+	childEntries(node, func(key string, value interface{}) {
+		if err != nil {
+			return
+		}
+		name := envName(key)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		err = flattenEnv(value, name, out)
+	})
+	return err
+}
+
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// quoteEnvValue leaves simple values bare and double-quotes everything else,
+// escaping the characters dotenv parsers and shells interpret inside quotes
+func quoteEnvValue(v string) string {
+	simple := v != "" && strings.IndexFunc(v, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_-.,:/@+%", r))
+	}) < 0
+	if simple {
+		return v
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, `$`, `\$`, "`", "\\`")
+	return `"` + r.Replace(v) + `"`
+}
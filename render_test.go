@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/sha256"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/config"
+	yamlstore "github.com/getsops/sops/v3/stores/yaml"
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestSplitRenderSuffix(t *testing.T) {
+	tests := []struct {
+		input    string
+		base     string
+		expected string
+	}{
+		{input: "/secrets/postgres.yaml", base: "/secrets/postgres", expected: renderYAML},
+		{input: "/secrets/postgres.json", base: "/secrets/postgres", expected: renderJSON},
+		{input: "/secrets/postgres.env", base: "/secrets/postgres", expected: renderEnv},
+		{input: "/secrets.yaml", base: "/secrets", expected: renderYAML},
+		{input: "/secrets/postgres.txt", base: "/secrets/postgres.txt", expected: ""},
+		{input: "/secrets/.env", base: "/secrets/.env", expected: ""},
+		{input: "/secrets/postgres", base: "/secrets/postgres", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			base, format := splitRenderSuffix(tt.input)
+			if base != tt.base || format != tt.expected {
+				t.Errorf("Expected (%q, %q), got (%q, %q)", tt.base, tt.expected, base, format)
+			}
+		})
+	}
+}
+
+func TestRenderDocument(t *testing.T) {
+	node := map[string]interface{}{
+		"host": "db.lan",
+		"port": 5432,
+		"admin": map[string]interface{}{
+			"pass": `p@ss "word"`,
+		},
+		"replicas": []interface{}{"a.lan", "b.lan"},
+		"dash-key": "x",
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format: renderYAML,
+			expected: "admin:\n  pass: p@ss \"word\"\n" +
+				"dash-key: x\nhost: db.lan\nport: 5432\nreplicas:\n  - a.lan\n  - b.lan\n",
+		},
+		{
+			format: renderJSON,
+			expected: "{\n  \"admin\": {\n    \"pass\": \"p@ss \\\"word\\\"\"\n  },\n" +
+				"  \"dash-key\": \"x\",\n  \"host\": \"db.lan\",\n  \"port\": 5432,\n" +
+				"  \"replicas\": [\n    \"a.lan\",\n    \"b.lan\"\n  ]\n}\n",
+		},
+		{
+			format: renderEnv,
+			expected: "admin_pass=\"p@ss \\\"word\\\"\"\ndash_key=x\nhost=db.lan\nport=5432\n" +
+				"replicas_0=a.lan\nreplicas_1=b.lan\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := renderDocument(tt.format, node)
+			if err != nil {
+				t.Fatalf("renderDocument: %v", err)
+			}
+			if string(got) != tt.expected {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadRenderedSubtree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	data := []byte(sopsFixture("postgres:\n  user: ENC[a]\n  pass: ENC[b]\n"))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SopsClient{trees: map[string]*decryptedTree{
+		path: {
+			hash:      sha256.Sum256(data),
+			root:      map[string]any{"postgres": map[string]any{"user": "admin", "pass": "s3cret"}},
+			timestamp: time.Now(),
+		},
+	}}
+	fs, err := NewSopsFS(client, []secretsSpec{{name: "secrets", path: path}}, sizeFromEnvelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/secrets/postgres.env", &stat, 0); errc != 0 {
+		t.Fatalf("Getattr returned %d", errc)
+	}
+	expected := "pass=s3cret\nuser=admin\n"
+	if stat.Mode&fuse.S_IFMT != fuse.S_IFREG || stat.Size != int64(len(expected)) {
+		t.Errorf("Unexpected stat mode=%o size=%d", stat.Mode, stat.Size)
+	}
+
+	buff := make([]byte, 4096)
+	n := fs.Read("/secrets/postgres.env", buff, 0, 0)
+	if string(buff[:max(n, 0)]) != expected {
+		t.Errorf("Expected %q, got %q", expected, buff[:max(n, 0)])
+	}
+
+	if errc := fs.Getattr("/secrets.json", &stat, 0); errc != 0 || stat.Mode&fuse.S_IFMT != fuse.S_IFREG {
+		t.Errorf("Expected whole-file document at /secrets.json, got errc=%d mode=%o", errc, stat.Mode)
+	}
+	if errc, _ := fs.Opendir("/secrets/postgres.yaml"); errc != -20 {
+		t.Errorf("Expected ENOTDIR opening a rendered document as a directory, got %d", errc)
+	}
+}
+
+func TestRealKeyShadowsRenderedDocument(t *testing.T) {
+	// .yaml is also stripped from every name, so x.yaml must not fall back to x
+	for _, suffix := range []string{".json", ".yaml"} {
+		t.Run(suffix, func(t *testing.T) {
+			real := "x" + suffix
+			path := filepath.Join(t.TempDir(), "secrets.yaml")
+			data := []byte(sopsFixture("x:\n  user: ENC[a]\n" + real + ": ENC[b]\n"))
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			client := &SopsClient{trees: map[string]*decryptedTree{
+				path: {
+					hash:      sha256.Sum256(data),
+					root:      map[string]any{"x": map[string]any{"user": "admin"}, real: "real"},
+					timestamp: time.Now(),
+				},
+			}}
+			fs, err := NewSopsFS(client, []secretsSpec{{name: "secrets", path: path}}, sizeFromDecrypt, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var stat fuse.Stat_t
+			if errc := fs.Getattr("/secrets/"+real, &stat, 0); errc != 0 || stat.Size != int64(len("real")) {
+				t.Errorf("Expected the size of the real key, got errc=%d size=%d", errc, stat.Size)
+			}
+			buff := make([]byte, 4096)
+			n := fs.Read("/secrets/"+real, buff, 0, 0)
+			if got := string(buff[:max(n, 0)]); got != "real" {
+				t.Errorf("Expected the real %s value, got %q", real, got)
+			}
+
+			var names []string
+			fs.Readdir("/secrets", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+				names = append(names, name)
+				return true
+			}, 0, 0)
+			if n := len(slices.DeleteFunc(names, func(name string) bool { return name != real })); n != 1 {
+				t.Errorf("Expected %s listed once, got %d", real, n)
+			}
+
+			// The other documents of x still render
+			n = fs.Read("/secrets/x.env", buff, 0, 0)
+			if got := string(buff[:max(n, 0)]); got != "user=admin\n" {
+				t.Errorf("Expected x rendered as env, got %q", got)
+			}
+			if errc, _ := fs.Opendir("/secrets/x"); errc != 0 {
+				t.Errorf("Expected x to stay a directory, got %d", errc)
+			}
+		})
+	}
+}
+
+// TestEncodeValueScalarTypes round-trips every scalar type SOPS can store
+// through a real encrypt/decrypt, and checks that the rendering matches the
+// size Getattr derives from the envelope
+func TestEncodeValueScalarTypes(t *testing.T) {
+	src := `str: hello
+empty_str: ""
+quoted_bool: "true"
+int: 42
+negative_int: -7
+float: 1.5
+exponent_float: 1e6
+tiny_float: 0.000001
+negative_float: -2.25
+whole_float: 3.0
+bool_true: true
+bool_false: false
+timestamp: 2001-12-14T21:59:43.1-05:00
+nothing: null
+`
+	expected := map[string]string{
+		"str":            "hello",
+		"empty_str":      "",
+		"quoted_bool":    "true",
+		"int":            "42",
+		"negative_int":   "-7",
+		"float":          "1.5",
+		"exponent_float": "1000000",
+		"tiny_float":     "0.000001",
+		"negative_float": "-2.25",
+		"whole_float":    "3",
+		"bool_true":      "true",
+		"bool_false":     "false",
+		"timestamp":      "2001-12-14T21:59:43.1-05:00",
+		"nothing":        "",
+	}
+
+	branches, err := yamlstore.NewStore(&config.YAMLStoreConfig{}).LoadPlainFile([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := sops.Tree{Branches: branches, Metadata: sops.Metadata{UnencryptedSuffix: "_unencrypted"}}
+	dataKey := make([]byte, 32)
+
+	if _, err := tree.Encrypt(dataKey, aes.NewCipher()); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	encrypted := branchesToMap("test.yaml", tree.Branches)
+
+	if _, err := tree.Decrypt(dataKey, aes.NewCipher()); err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	decrypted := branchesToMap("test.yaml", tree.Branches)
+
+	for key, want := range expected {
+		t.Run(key, func(t *testing.T) {
+			got, err := encodeValue(decrypted[key])
+			if err != nil {
+				t.Fatalf("encodeValue(%#v): %v", decrypted[key], err)
+			}
+			if got != want {
+				t.Errorf("encodeValue(%#v) = %q, want %q", decrypted[key], got, want)
+			}
+
+			if size, ok := envelopeSize(encrypted[key]); ok && size != int64(len(got)) {
+				t.Errorf("Envelope size %d does not match rendered length %d", size, len(got))
+			}
+		})
+	}
+}
+
+func TestEncodeValueSpecialFloatsAndStructures(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{name: "positive infinity", value: math.Inf(1), expected: ".inf"},
+		{name: "negative infinity", value: math.Inf(-1), expected: "-.inf"},
+		{name: "not a number", value: math.NaN(), expected: ".nan"},
+		{name: "bytes", value: []byte("raw"), expected: "raw"},
+		{
+			name:     "nested map",
+			value:    map[string]interface{}{"b": 1e6, "a": map[string]interface{}{"on": true}, "n": nil},
+			expected: "a:\n  on: true\nb: 1000000.0\nn: null\n",
+		},
+		{
+			name:     "sequence",
+			value:    []interface{}{"1", 2, "true"},
+			expected: "- \"1\"\n- 2\n- \"true\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeValue(tt.value)
+			if err != nil {
+				t.Fatalf("encodeValue: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// defaultSecretsName is the top-level directory used for a -secrets value
+// given as a bare path, matching the historical /secrets layout
+const defaultSecretsName = "secrets"
+
+// secretsSpec is one -secrets value: a SOPS file and the top-level directory
+// it is mounted as
+type secretsSpec struct {
+	name   string
+	path   string
+	format string // empty falls back to -format, then to the file extension
+}
+
+// parseSecretsSpec parses name=path or a bare path, either optionally
+// followed by :format. Only a known store format counts as a suffix, so
+// drive letters and other colons stay part of the path.
+func parseSecretsSpec(v string) (secretsSpec, error) {
+	name, path, found := strings.Cut(v, "=")
+	if !found {
+		name, path = defaultSecretsName, v
+	}
+	var format string
+	if i := strings.LastIndex(path, ":"); i >= 0 && slices.Contains(storeFormats, path[i+1:]) {
+		path, format = path[:i], path[i+1:]
+	}
+
+	if path == "" {
+		return secretsSpec{}, fmt.Errorf("empty secrets file path in %q", v)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return secretsSpec{}, fmt.Errorf("invalid mount name %q in %q", name, v)
+	}
+	return secretsSpec{name: name, path: path, format: format}, nil
+}
+
+// secretsFlag collects repeatable -secrets name=path[:format] values
+type secretsFlag []secretsSpec
+
+func (f *secretsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	parts := make([]string, len(*f))
+	for i, s := range *f {
+		parts[i] = s.name + "=" + s.path
+		if s.format != "" {
+			parts[i] += ":" + s.format
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *secretsFlag) Set(v string) error {
+	spec, err := parseSecretsSpec(v)
+	if err != nil {
+		return err
+	}
+	for _, existing := range *f {
+		if existing.name == spec.name {
+			return fmt.Errorf("mount name %q used more than once", spec.name)
+		}
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// secretsFile is one mounted SOPS file with its own structure, decrypt cache
+// and reload state
+type secretsFile struct {
+	name   string
+	path   string
+	format string
+	binary bool
+	tree   map[string]interface{}
+	cache  map[string]cachedSecret
+	mu     sync.RWMutex
+}
+
+func newSecretsFile(spec secretsSpec) *secretsFile {
+	return &secretsFile{
+		name:   spec.name,
+		path:   spec.path,
+		format: spec.format,
+		binary: isBinaryFormat(spec.path, spec.format),
+		cache:  make(map[string]cachedSecret),
+	}
+}
+
+// evictLocked removes the cached value for path and wipes its plaintext.
+// Caller must hold sf.mu for writing.
+func (sf *secretsFile) evictLocked(path string) {
+	if cached, ok := sf.cache[path]; ok {
+		cached.value.wipe()
+		delete(sf.cache, path)
+	}
+}
+
+// wipeCache evicts every cached value and returns how many there were
+func (sf *secretsFile) wipeCache() int {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+
+	n := len(sf.cache)
+	for path := range sf.cache {
+		sf.evictLocked(path)
+	}
+	return n
+}
+
+// resolveKeyPath maps a key path inside the mount onto the SOPS tree. A binary
+// file is mounted as a single file backed by the store's data key.
+func (sf *secretsFile) resolveKeyPath(keyPath []string) []string {
+	if sf.binary && len(keyPath) == 0 {
+		return []string{binaryDataKey}
+	}
+	return keyPath
+}
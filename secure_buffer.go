@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// secretBuffer holds one plaintext value outside the Go heap, in a slot of
+// the shared locked arena, so it can be zeroed the moment it is evicted
+// instead of lingering until the garbage collector reuses it. Platforms or
+// accounts that cannot lock memory fall back to a heap slice, which is still
+// zeroed. Only cached values use it: the decrypted trees SOPS returns stay
+// heap strings.
+type secretBuffer struct {
+	mem    []byte // the value; cap covers its whole arena slot
+	locked bool
+}
+
+// releaseLocked returns a locked slot to the arena; tests replace it to
+// inspect the memory after a wipe
+var releaseLocked = secretArena.free
+
+var lockFallbackOnce sync.Once
+
+// newSecretBuffer copies data into a new locked buffer. The caller still owns
+// data and should clear it.
+func newSecretBuffer(data []byte) *secretBuffer {
+	b := &secretBuffer{}
+	if len(data) == 0 {
+		return b
+	}
+
+	mem, err := secretArena.alloc(len(data))
+	if err != nil {
+		lockFallbackOnce.Do(func() {
+			cacheLog.Warn("Cannot lock memory, cached secrets may be paged to disk", "error", err)
+		})
+		mem = make([]byte, len(data))
+	} else {
+		b.locked = true
+	}
+	copy(mem, data)
+	b.mem = mem
+	return b
+}
+
+const (
+	// arenaChunkSize is how much memory the arena locks at a time. Packing
+	// values keeps hundreds of secrets within one chunk, well inside the
+	// smallest RLIMIT_MEMLOCK and Windows working set defaults, where a page
+	// per value would exhaust them.
+	arenaChunkSize = 64 << 10
+	// arenaSlot is the allocation unit inside a chunk
+	arenaSlot = 64
+)
+
+// secretArena holds every locked secret buffer
+var secretArena = &lockedArena{}
+
+// lockedArena packs buffers into shared chunks of locked memory. A value
+// larger than a chunk gets a chunk of its own.
+type lockedArena struct {
+	mu     sync.Mutex
+	chunks []*arenaChunk
+}
+
+type arenaChunk struct {
+	mem   []byte
+	used  []bool // per slot
+	inUse int    // slots in use
+}
+
+// alloc returns n bytes of locked memory whose cap covers the slots taken
+func (a *lockedArena) alloc(n int) ([]byte, error) {
+	slots := (n + arenaSlot - 1) / arenaSlot
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.chunks {
+		if mem, ok := c.alloc(n, slots); ok {
+			return mem, nil
+		}
+	}
+
+	mem, err := lockedAlloc(max(arenaChunkSize, pageRound(n)))
+	if err != nil {
+		return nil, err
+	}
+	mem = mem[:cap(mem)]
+	c := &arenaChunk{mem: mem, used: make([]bool, len(mem)/arenaSlot)}
+	a.chunks = append(a.chunks, c)
+	mem, _ = c.alloc(n, slots)
+	return mem, nil
+}
+
+// alloc takes the first run of free slots long enough for n bytes
+func (c *arenaChunk) alloc(n, slots int) ([]byte, bool) {
+	run := 0
+	for i, used := range c.used {
+		if used {
+			run = 0
+			continue
+		}
+		if run++; run < slots {
+			continue
+		}
+		first := i + 1 - slots
+		for j := first; j <= i; j++ {
+			c.used[j] = true
+		}
+		c.inUse += slots
+		off := first * arenaSlot
+		return c.mem[off : off+n : off+slots*arenaSlot], true
+	}
+	return nil, false
+}
+
+// free returns a slot the caller has zeroed to its chunk. Empty chunks are
+// unlocked and unmapped, except the first, which is kept for the next value.
+func (a *lockedArena) free(mem []byte) error {
+	mem = mem[:cap(mem)]
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(mem)))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, c := range a.chunks {
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(c.mem)))
+		if addr < base || addr >= base+uintptr(len(c.mem)) {
+			continue
+		}
+		first, slots := int(addr-base)/arenaSlot, len(mem)/arenaSlot
+		clear(c.used[first : first+slots])
+		c.inUse -= slots
+		if c.inUse > 0 || i == 0 {
+			return nil
+		}
+		a.chunks = slices.Delete(a.chunks, i, i+1)
+		return lockedFree(c.mem)
+	}
+	return errors.New("buffer is not from the locked arena")
+}
+
+// Bytes returns the plaintext. The slice must not be used after wipe.
+func (b *secretBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.mem
+}
+
+func (b *secretBuffer) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.mem)
+}
+
+// wipe zeroes the whole slot and releases it. Safe to call twice.
+func (b *secretBuffer) wipe() {
+	if b == nil || b.mem == nil {
+		return
+	}
+	mem := b.mem[:cap(b.mem)]
+	clear(mem)
+	if b.locked {
+		if err := releaseLocked(mem); err != nil {
+			cacheLog.Error("Failed to release locked buffer", "error", err)
+		}
+	}
+	b.mem, b.locked = nil, false
+}
+
+// pageRound rounds n up to a whole number of pages, the unit memory is locked in
+func pageRound(n int) int {
+	page := os.Getpagesize()
+	return (n + page - 1) / page * page
+}
+
+// LogValue keeps a buffer's contents out of logs whatever it is passed to
+func (b *secretBuffer) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+// String keeps a buffer's contents out of fmt verbs such as %s and %v
+func (b *secretBuffer) String() string {
+	return redacted
+}
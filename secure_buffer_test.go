@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// keepLockedMemory stops wipe from unmapping locked buffers for the rest of
+// the test, so their contents can still be inspected afterwards
+func keepLockedMemory(t *testing.T) {
+	t.Helper()
+	var kept [][]byte
+	releaseLocked = func(mem []byte) error {
+		kept = append(kept, mem)
+		return nil
+	}
+	t.Cleanup(func() {
+		releaseLocked = secretArena.free
+		for _, mem := range kept {
+			secretArena.free(mem)
+		}
+	})
+}
+
+// backing returns the whole allocation behind a buffer's plaintext
+func backing(b []byte) []byte {
+	return b[:cap(b)]
+}
+
+func assertZeroed(t *testing.T, name string, mem []byte) {
+	t.Helper()
+	if len(mem) == 0 {
+		t.Fatalf("%s: no memory captured", name)
+	}
+	for i, c := range mem {
+		if c != 0 {
+			t.Fatalf("%s: byte %d of %d not wiped", name, i, len(mem))
+		}
+	}
+}
+
+func TestSecretBufferWipe(t *testing.T) {
+	keepLockedMemory(t)
+
+	b := newSecretBuffer([]byte("hunter2"))
+	if string(b.Bytes()) != "hunter2" || b.Len() != 7 {
+		t.Fatalf("Unexpected buffer contents %q", b.Bytes())
+	}
+	if !b.locked {
+		t.Logf("Memory locking unavailable, testing the heap fallback")
+	}
+
+	mem := backing(b.Bytes())
+	b.wipe()
+	assertZeroed(t, "wiped buffer", mem)
+	if b.Bytes() != nil || b.Len() != 0 {
+		t.Errorf("Expected a wiped buffer to be empty, got %q", b.Bytes())
+	}
+	b.wipe()
+
+	if empty := newSecretBuffer(nil); empty.Len() != 0 {
+		t.Errorf("Expected an empty buffer")
+	}
+}
+
+func TestLockedArenaPacksValues(t *testing.T) {
+	a := &lockedArena{}
+	probe, err := a.alloc(1)
+	if err != nil {
+		t.Skipf("Memory locking unavailable: %v", err)
+	}
+	a.free(probe)
+
+	// A page per value would need far more than a small memlock limit allows
+	var slots [][]byte
+	for i := 0; i < 500; i++ {
+		mem, err := a.alloc(10)
+		if err != nil {
+			t.Fatalf("Value %d: %v", i, err)
+		}
+		copy(mem, fmt.Sprintf("secret-%03d", i))
+		slots = append(slots, mem)
+	}
+	if n := len(a.chunks); n != 1 {
+		t.Errorf("Expected 500 small values in one chunk, got %d chunks", n)
+	}
+	for i, mem := range slots {
+		if want := fmt.Sprintf("secret-%03d", i); string(mem) != want {
+			t.Fatalf("Value %d: expected %q, got %q", i, want, mem)
+		}
+	}
+
+	// Freeing one slot leaves its neighbours intact, and the slot is reused
+	freed := backing(slots[1])
+	clear(freed)
+	if err := a.free(slots[1]); err != nil {
+		t.Fatal(err)
+	}
+	if string(slots[0]) != "secret-000" || string(slots[2]) != "secret-002" {
+		t.Errorf("Expected neighbouring slots untouched, got %q and %q", slots[0], slots[2])
+	}
+	if reused, _ := a.alloc(5); &backing(reused)[0] != &freed[0] {
+		t.Errorf("Expected the freed slot to be reused")
+	} else {
+		slots[1] = reused
+	}
+
+	// A value larger than a chunk gets a chunk of its own
+	big, err := a.alloc(arenaChunkSize + 1)
+	if err != nil || len(a.chunks) != 2 {
+		t.Fatalf("Expected a dedicated chunk, got %d chunks: %v", len(a.chunks), err)
+	}
+	if err := a.free(big); err != nil || len(a.chunks) != 1 {
+		t.Errorf("Expected the dedicated chunk released, got %d chunks: %v", len(a.chunks), err)
+	}
+
+	// The first chunk stays for the next value
+	for _, mem := range slots {
+		a.free(mem)
+	}
+	if len(a.chunks) != 1 || a.chunks[0].inUse != 0 {
+		t.Errorf("Expected one empty chunk, got %d", len(a.chunks))
+	}
+	if err := a.free(make([]byte, 8)); err == nil {
+		t.Errorf("Expected a heap slice to be refused")
+	}
+	lockedFree(a.chunks[0].mem)
+}
+
+func TestCachedSecretsWiped(t *testing.T) {
+	keepLockedMemory(t)
+
+	fs, _ := mountFixture(t, "secrets", "api:\n  token: t0k3n\nwifi: hunter2\nvpn: c0rrect\n", cachePolicy{{glob: "secrets/api/*", ttl: 0}})
+	sf := fs.files["secrets"]
+
+	cachedMemory := func(p string) []byte {
+		t.Helper()
+		if _, err := fs.readSecret(p); err != nil {
+			t.Fatalf("readSecret(%s): %v", p, err)
+		}
+		cached, ok := sf.cache[p]
+		if !ok {
+			t.Fatalf("Expected %s to be cached", p)
+		}
+		return backing(cached.value.Bytes())
+	}
+
+	t.Run("uncached", func(t *testing.T) {
+		var mem []byte
+		_, err := fs.withSecret("/secrets/api/token", func(secret []byte) {
+			if string(secret) != "t0k3n" {
+				t.Errorf("Expected t0k3n, got %q", secret)
+			}
+			mem = backing(secret)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertZeroed(t, "TTL 0 value", mem)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		mem := cachedMemory("/secrets/wifi")
+		cached := sf.cache["/secrets/wifi"]
+		cached.timestamp = time.Now().Add(-2 * cached.ttl)
+		sf.cache["/secrets/wifi"] = cached
+
+		fs.purgeExpiredSecrets()
+		assertZeroed(t, "expired value", mem)
+		if _, ok := sf.cache["/secrets/wifi"]; ok {
+			t.Errorf("Expected expired value to be evicted")
+		}
+	})
+
+	t.Run("replaced", func(t *testing.T) {
+		mem := cachedMemory("/secrets/wifi")
+		cached := sf.cache["/secrets/wifi"]
+		cached.timestamp = time.Now().Add(-2 * cached.ttl)
+		sf.cache["/secrets/wifi"] = cached
+
+		cachedMemory("/secrets/wifi")
+		assertZeroed(t, "stale value replaced by a fresh decrypt", mem)
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		wifi := cachedMemory("/secrets/wifi")
+		vpn := cachedMemory("/secrets/vpn")
+
+		fs.wipeSecrets()
+		assertZeroed(t, "wifi after unmount", wifi)
+		assertZeroed(t, "vpn after unmount", vpn)
+		if len(sf.cache) != 0 || len(fs.sopsClient.trees) != 0 {
+			t.Errorf("Expected no cached values or trees, got %d values and %d trees", len(sf.cache), len(fs.sopsClient.trees))
+		}
+	})
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// lockedAlloc maps anonymous memory for n bytes and locks it into RAM
+func lockedAlloc(n int) ([]byte, error) {
+	mem, err := unix.Mmap(-1, 0, pageRound(n), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Mlock(mem); err != nil {
+		unix.Munmap(mem)
+		return nil, err
+	}
+	return mem[:n], nil
+}
+
+// lockedFree unlocks and unmaps an allocation from lockedAlloc
+func lockedFree(mem []byte) error {
+	mem = mem[:cap(mem)]
+	if err := unix.Munlock(mem); err != nil {
+		return err
+	}
+	return unix.Munmap(mem)
+}
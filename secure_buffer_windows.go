@@ -0,0 +1,55 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockedAlloc commits private pages for n bytes and locks them into the
+// working set. Windows caps locked pages at the minimum working set, which
+// defaults to well under a MiB and is shared with everything else the process
+// touches, so it is raised by the allocation size whenever the cap is hit.
+func lockedAlloc(n int) ([]byte, error) {
+	size := uintptr(pageRound(n))
+	addr, err := windows.VirtualAlloc(0, size, windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_READWRITE)
+	if err != nil {
+		return nil, err
+	}
+	err = windows.VirtualLock(addr, size)
+	if errors.Is(err, windows.ERROR_WORKING_SET_QUOTA) {
+		if err = growWorkingSet(size); err == nil {
+			err = windows.VirtualLock(addr, size)
+		}
+	}
+	if err != nil {
+		windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+		return nil, err
+	}
+	// VirtualAlloc memory is not managed by the Go runtime
+	mem := unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&addr))), size)
+	return mem[:n], nil
+}
+
+// lockedFree unlocks and releases an allocation from lockedAlloc
+func lockedFree(mem []byte) error {
+	mem = mem[:cap(mem)]
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	if err := windows.VirtualUnlock(addr, uintptr(len(mem))); err != nil {
+		return err
+	}
+	return windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+}
+
+// growWorkingSet raises the minimum and maximum working set of the process by
+// n bytes so n more bytes can be locked
+func growWorkingSet(n uintptr) error {
+	var minSize, maxSize uintptr
+	var flags uint32
+	process := windows.CurrentProcess()
+	windows.GetProcessWorkingSetSizeEx(process, &minSize, &maxSize, &flags)
+	return windows.SetProcessWorkingSetSizeEx(process, minSize+n, maxSize+n, flags)
+}
@@ -2,194 +2,510 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
-	"log"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/getsops/sops/v3"
 	"github.com/getsops/sops/v3/aes"
 	sopscommon "github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
 	"github.com/getsops/sops/v3/keyservice"
-	yamlstore "github.com/getsops/sops/v3/stores/yaml"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"gopkg.in/yaml.v3"
+	"google.golang.org/grpc/connectivity"
 )
 
+const decryptedTreeTTL = 5 * time.Minute
+
+// binaryDataKey is where the SOPS binary store keeps the file content
+const binaryDataKey = "data"
+
+// decryptedTree is the plaintext form of one version of a SOPS file. It is
+// keyed by the SHA-256 of the encrypted file so any edit invalidates it. The
+// values are ordinary heap strings, neither locked nor zeroed; only the value
+// cache uses locked memory.
+type decryptedTree struct {
+	hash      [sha256.Size]byte
+	root      any
+	timestamp time.Time
+	servedBy  []string // key services that unwrapped the data key
+}
+
 type SopsClient struct {
-	keyserviceAddr string
-	conn           *grpc.ClientConn
-	services       []keyservice.KeyServiceClient
+	// services are the local client and/or the remote endpoints in configured
+	// order; orderedServices sorts them by health for each decrypt
+	services []*trackedKeyservice
+
+	// treeMu guards the maps below and is never held across a decrypt, so a
+	// slow keyservice for one file does not block cache hits for the others
+	treeMu   sync.Mutex
+	trees    map[string]*decryptedTree
+	treeTTLs map[string]time.Duration // per file; decryptedTreeTTL if unset
+	// decryptMus are held across a decrypt of their file, so concurrent
+	// cache misses for it share one data-key unwrap instead of racing to the
+	// keyservice
+	decryptMus map[string]*sync.Mutex
+
+	// grace keeps data keys for offline use; nil unless -offline-grace is set
+	grace *graceCache
 }
 
 // configureSOPSKeyservice normalizes the endpoint for diagnostics and smoke tests
 func configureSOPSKeyservice(addr string) error {
-	endpoint := addr
-	if !(strings.HasPrefix(addr, "tcp://") || strings.HasPrefix(addr, "unix://")) {
-		endpoint = "tcp://" + addr
+	endpoints, err := parseKeyserviceEndpoints(addr)
+	if err != nil {
+		return err
 	}
 
-	// For smoke test compatibility, still set the environment
-	if err := os.Setenv("SOPS_KEYSERVICE", endpoint); err != nil {
+	normalized := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		normalized[i] = e.String()
+	}
+
+	// Mirror the endpoints for sops CLI invocations sharing this environment
+	if err := os.Setenv("SOPS_KEYSERVICE", strings.Join(normalized, ",")); err != nil {
 		return err
 	}
 
-	log.Printf("[Diag] Normalized keyservice endpoint: %s", endpoint)
+	keyserviceLog.Info("Normalized keyservice endpoints", "endpoints", strings.Join(normalized, ", "))
 	return nil
 }
 
-// sopsMeta represents the SOPS metadata structure for diagnostics
-type sopsMeta struct {
-	Sops struct {
-		Age []struct {
-			Recipient string `yaml:"recipient"`
-		} `yaml:"age"`
-		Pgp []struct {
-			FP string `yaml:"fp"`
-		} `yaml:"pgp"`
-		KMS []struct {
-			ARN string `yaml:"arn"`
-		} `yaml:"kms"`
-		GCPCMS []struct {
-			ResourceID string `yaml:"resource_id"`
-		} `yaml:"gcp_kms"`
-		AzureKV []struct {
-			Name string `yaml:"name"`
-		} `yaml:"azure_kv"`
-		Vault []any `yaml:"hc_vault"`
-	} `yaml:"sops"`
-}
-
 // LogSopsRecipients reads the SOPS file and logs the key recipients for diagnostics
-func LogSopsRecipients(path string) {
+func LogSopsRecipients(path, format string) {
 	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("[Diag] read %s: %v", path, err)
+		sopsLog.Warn("Cannot read secrets file for diagnostics", "file", path, "error", err)
 		return
 	}
-	var m sopsMeta
-	if err := yaml.Unmarshal(b, &m); err != nil {
-		log.Printf("[Diag] parse %s: %v", path, err)
+	tree, err := storeForFile(path, format).LoadEncryptedFile(b)
+	if err != nil {
+		sopsLog.Warn("Cannot parse secrets file for diagnostics", "file", path, "error", err)
 		return
 	}
+
+	counts := make(map[string]int)
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			counts[key.TypeToIdentifier()]++
+		}
+	}
 	// Summarize without values
-	log.Printf("[Diag] sops.age recipients=%d, pgp=%d, kms=%d, gcp_kms=%d, azure_kv=%d, vault=%d",
-		len(m.Sops.Age), len(m.Sops.Pgp), len(m.Sops.KMS), len(m.Sops.GCPCMS), len(m.Sops.AzureKV), len(m.Sops.Vault))
+	sopsLog.Info("Recipients in sops metadata", "file", path,
+		"age", counts["age"], "pgp", counts["pgp"], "kms", counts["kms"], "gcp_kms", counts["gcp_kms"], "azure_kv", counts["azure_kv"], "vault", counts["hc_vault"])
 }
 
-func NewSopsClient(addr string) (*SopsClient, error) {
-	log.Printf("[SopsClient] Using remote SOPS keyservice at %s", addr)
+// storeFormats are the values accepted for an explicit store format; an empty
+// format selects the store from the file extension like the sops CLI does
+var storeFormats = []string{"yaml", "json", "dotenv", "ini", "binary"}
 
-	// Normalize: strip tcp:// for grpc.Dial, which expects host:port
-	target := strings.TrimPrefix(addr, "tcp://")
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+func validateStoreFormat(format string) error {
+	if format == "" || slices.Contains(storeFormats, format) {
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (want one of %s)", format, strings.Join(storeFormats, ", "))
+}
 
-	conn, err := grpc.DialContext(ctx, target, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	if err != nil {
-		return nil, fmt.Errorf("dial keyservice %q: %w", target, err)
+// storeForFile picks the SOPS store for a secrets file from an explicit format,
+// falling back to the file extension
+func storeForFile(filePath, format string) sopscommon.Store {
+	return sopscommon.DefaultStoreForPathOrFormat(config.NewStoresConfig(), filePath, format)
+}
+
+// isBinaryFormat reports whether the file is stored with the SOPS binary
+// store, whose whole content lives under a single "data" key
+func isBinaryFormat(filePath, format string) bool {
+	return formats.FormatForPathOrString(filePath, format) == formats.Binary
+}
+
+// branchToMap converts a SOPS tree branch into the generic map form used by the
+// filesystem. Comments are dropped and keys are stringified.
+func branchToMap(branch sops.TreeBranch) map[string]interface{} {
+	m := make(map[string]interface{}, len(branch))
+	for _, item := range branch {
+		if _, isComment := item.Key.(sops.Comment); isComment {
+			continue
+		}
+		m[fmt.Sprint(item.Key)] = treeValue(item.Value)
+	}
+	return m
+}
+
+func treeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case sops.TreeBranch:
+		return branchToMap(v)
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if _, isComment := item.(sops.Comment); isComment {
+				continue
+			}
+			out = append(out, treeValue(item))
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// branchesToMap returns the first document of a tree as a map. Only YAML can
+// hold several documents; the rest are ignored with a warning.
+func branchesToMap(filePath string, branches sops.TreeBranches) map[string]interface{} {
+	if len(branches) == 0 {
+		return map[string]interface{}{}
+	}
+	if len(branches) > 1 {
+		sopsLog.Warn("Only the first document is mounted", "file", filePath, "documents", len(branches))
 	}
+	return branchToMap(branches[0])
+}
 
-	// Remote gRPC keyservice client
-	remote := keyservice.NewKeyServiceClient(conn)
+// NewSopsClient sets up the key services selected by mode. Remote endpoints in
+// the comma-separated addr list are connected in the background and reconnect
+// with exponential backoff, so the client starts even while they are down.
+func NewSopsClient(addr string, tlsCfg keyserviceTLS, mode keyserviceMode) (*SopsClient, error) {
+	c := &SopsClient{trees: make(map[string]*decryptedTree)}
 
-	// Include both local and remote clients during transition
-	// TODO: Remove local client once remote-only is desired
-	svcs := []keyservice.KeyServiceClient{keyservice.NewLocalClient(), remote}
+	if mode.useLocal() {
+		keyserviceLog.Info("Using local key service (keys and credentials of the current user)")
+		c.services = append(c.services, newTrackedKeyservice(localKeyserviceName, keyservice.NewLocalClient(), nil))
+	}
 
-	log.Printf("[SopsClient] Configured %d KeyServices: local + remote gRPC to %s", len(svcs), addr)
+	if mode.useRemote() {
+		keyserviceLog.Info("Using remote SOPS keyservice", "endpoints", addr, "transport", tlsCfg.String())
 
-	return &SopsClient{keyserviceAddr: addr, conn: conn, services: svcs}, nil
+		endpoints, err := parseKeyserviceEndpoints(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, endpoint := range endpoints {
+			svc, err := connectKeyservice(endpoint, tlsCfg)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			c.services = append(c.services, svc)
+		}
+
+		// Give the endpoints a moment so the startup log says whether they are up
+		ctx, cancel := context.WithTimeout(context.Background(), keyserviceStartupWait)
+		defer cancel()
+		reachable := 0
+		for _, svc := range c.services {
+			if svc.conn != nil && svc.waitReady(ctx) {
+				reachable++
+			}
+		}
+		if reachable == 0 {
+			keyserviceLog.Warn("No keyservice endpoint reachable yet; reads fail with EAGAIN until one connects")
+		} else {
+			keyserviceLog.Info("Remote endpoints reachable", "reachable", reachable, "endpoints", len(endpoints))
+		}
+	}
+
+	keyserviceLog.Info("Configured key services", "mode", string(mode), "services", strings.Join(c.serviceNames(), ", "))
+	return c, nil
 }
 
 func (c *SopsClient) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+	var firstErr error
+	for _, svc := range c.services {
+		if svc.conn == nil {
+			continue
+		}
+		if err := svc.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	return firstErr
 }
 
-func (c *SopsClient) GetSecretsStructure(filePath string) (map[string]interface{}, error) {
-	log.Printf("[SopsClient] Reading secrets structure from %s", filePath)
+func (c *SopsClient) GetSecretsStructure(filePath, format string) (map[string]interface{}, error) {
+	sopsLog.Debug("Reading secrets structure", "file", filePath)
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read SOPS file: %w", err)
 	}
 
-	var sopsFile map[string]interface{}
-	if err := yaml.Unmarshal(data, &sopsFile); err != nil {
-		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	// The encrypted tree is enough for the structure: values stay ENC[...] envelopes
+	tree, err := storeForFile(filePath, format).LoadEncryptedFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SOPS file: %w", err)
+	}
+
+	structure := branchesToMap(filePath, tree.Branches)
+	if isBinaryFormat(filePath, format) {
+		// Binary files are a single blob; keep just the data key
+		structure = map[string]interface{}{binaryDataKey: structure[binaryDataKey]}
+	} else if formats.FormatForPathOrString(filePath, format) == formats.Ini {
+		// go-ini always reports a DEFAULT section; hide it unless it has keys
+		if def, ok := structure["DEFAULT"].(map[string]interface{}); ok && len(def) == 0 {
+			delete(structure, "DEFAULT")
+		}
 	}
 
-	delete(sopsFile, "sops")
-	log.Printf("[SopsClient] Loaded structure with %d top-level keys", len(sopsFile))
-	return sopsFile, nil
+	sopsLog.Debug("Loaded secrets structure", "file", filePath, "top_level_keys", len(structure))
+	return structure, nil
 }
 
-func (c *SopsClient) DecryptKey(ctx context.Context, filePath string, keyPath []string) (string, error) {
-	start := time.Now()
-	log.Printf("[SopsClient] Decrypting key %v from %s", keyPath, filePath)
+func (c *SopsClient) DecryptKey(ctx context.Context, filePath, format string, keyPath []string) (string, error) {
+	node, err := c.DecryptSubtree(ctx, filePath, format, keyPath)
+	if err != nil {
+		return "", err
+	}
+	return encodeValue(node)
+}
+
+// DecryptSubtree returns the decrypted node at keyPath, which may be a leaf or
+// a whole map or sequence. The result is shared with the tree cache and must
+// not be modified.
+func (c *SopsClient) DecryptSubtree(ctx context.Context, filePath, format string, keyPath []string) (any, error) {
+	sopsLog.Debug("Decrypting", "file", filePath, "key_path", strings.Join(keyPath, "/"))
+
+	root, err := c.decryptedRoot(ctx, filePath, format)
+	if err != nil {
+		return nil, err
+	}
 
-	// 1) Load encrypted YAML into a SOPS tree
+	cur := root
+	for _, k := range keyPath {
+		if !isDirNode(cur) {
+			return nil, fmt.Errorf("path error at %q", k)
+		}
+		v, ok := childNode(cur, k)
+		if !ok {
+			return nil, fmt.Errorf("key not found: %v", keyPath)
+		}
+		cur = v
+	}
+	return cur, nil
+}
+
+// decryptedRoot returns the plaintext tree of filePath, decrypting it only when
+// the file content changed or the cached copy outlived the file's tree TTL
+func (c *SopsClient) decryptedRoot(ctx context.Context, filePath, format string) (any, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return "", fmt.Errorf("read encrypted file: %w", err)
+		return nil, fmt.Errorf("read encrypted file: %w", err)
+	}
+	hash := sha256.Sum256(data)
+
+	if root, ok := c.cachedRoot(filePath, hash); ok {
+		return root, nil
 	}
 
-	ys := &yamlstore.Store{}
-	tree, err := ys.LoadEncryptedFile(data)
+	mu := c.decryptMu(filePath)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Another reader may have decrypted this version while we waited
+	if root, ok := c.cachedRoot(filePath, hash); ok {
+		return root, nil
+	}
+
+	root, servedBy, err := c.decryptFile(ctx, filePath, format, data)
 	if err != nil {
-		return "", fmt.Errorf("load encrypted file: %w", err)
+		return nil, err
 	}
 
-	// 2) Decrypt the tree using the remote+local keyservices (matches CLI flow)
-	_, err = sopscommon.DecryptTree(sopscommon.DecryptTreeOpts{
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+	if c.treeTTLLocked(filePath) == 0 {
+		return root, nil
+	}
+	c.wipeTreeLocked(filePath)
+	c.trees[filePath] = &decryptedTree{
+		hash:      hash,
+		root:      root,
+		timestamp: time.Now(),
+		servedBy:  servedBy,
+	}
+	return root, nil
+}
+
+// cachedRoot returns the cached tree of filePath if it is still fresh and
+// decrypted from the file content with the given hash, dropping it otherwise
+func (c *SopsClient) cachedRoot(filePath string, hash [sha256.Size]byte) (any, bool) {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	cached, ok := c.trees[filePath]
+	if !ok {
+		return nil, false
+	}
+	if cached.hash == hash && time.Since(cached.timestamp) < c.treeTTLLocked(filePath) {
+		cacheLog.Debug("Decrypted tree cache hit", "file", filePath)
+		return cached.root, true
+	}
+	c.wipeTreeLocked(filePath)
+	return nil, false
+}
+
+// decryptMu returns the mutex serializing decrypts of filePath
+func (c *SopsClient) decryptMu(filePath string) *sync.Mutex {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	if c.decryptMus == nil {
+		c.decryptMus = make(map[string]*sync.Mutex)
+	}
+	mu, ok := c.decryptMus[filePath]
+	if !ok {
+		mu = new(sync.Mutex)
+		c.decryptMus[filePath] = mu
+	}
+	return mu
+}
+
+// decryptFile decrypts one version of a SOPS file and reports which key
+// services unwrapped its data key
+func (c *SopsClient) decryptFile(ctx context.Context, filePath, format string, data []byte) (any, []string, error) {
+	start := time.Now()
+
+	// 1) Load the encrypted file into a SOPS tree
+	tree, err := storeForFile(filePath, format).LoadEncryptedFile(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load encrypted file: %w", err)
+	}
+
+	// 2) Decrypt the tree using the key services, healthiest first (matches CLI flow)
+	var servedBy []string
+	var svcs []keyservice.KeyServiceClient
+	for _, svc := range c.orderedServices() {
+		svcs = append(svcs, attributedKeyservice{svc, &servedBy})
+	}
+	dataKey, err := sopscommon.DecryptTree(sopscommon.DecryptTreeOpts{
 		Tree:        &tree,
-		KeyServices: c.services,
+		KeyServices: svcs,
 		IgnoreMac:   false,
 		Cipher:      aes.NewCipher(),
 	})
+	if err != nil && !c.IsConnected() {
+		servedBy, err = c.decryptWithGraceKey(&tree, filePath, err)
+	}
 	if err != nil {
-		log.Printf("[SopsClient] decrypt failed after %s: %v (KeyServices=%d)",
-			time.Since(start), err, len(c.services))
-		return "", fmt.Errorf("sops decrypt failed: %w", err)
+		sopsLog.Error("Decrypt failed", "file", filePath, "duration", time.Since(start), "error", err, "key_services", len(svcs))
+		if !c.IsConnected() {
+			return nil, nil, fmt.Errorf("%w: %v", ErrKeyserviceUnavailable, err)
+		}
+		return nil, nil, fmt.Errorf("sops decrypt failed: %w", err)
 	}
-	log.Printf("[SopsClient] decrypt ok in %s", time.Since(start))
+	sopsLog.Info("Decrypted", "file", filePath, "duration", time.Since(start), "served_by", strings.Join(servedBy, ", "))
 
-	// 3) Emit plaintext YAML and extract the requested key
-	plaintext, err := ys.EmitPlainFile(tree.Branches)
-	if err != nil {
-		return "", fmt.Errorf("emit plaintext: %w", err)
+	if c.grace != nil && dataKey != nil {
+		if err := c.grace.store(filePath, dataKey); err != nil {
+			cacheLog.Warn("Cannot keep offline data key", "file", filePath, "error", err)
+		}
 	}
+	clear(dataKey)
+
+	// 3) Convert the decrypted branches straight into a generic tree
+	return branchesToMap(filePath, tree.Branches), servedBy, nil
+}
 
-	var root any
-	if err := yaml.Unmarshal(plaintext, &root); err != nil {
-		return "", fmt.Errorf("parse decrypted YAML: %w", err)
+// decryptWithGraceKey decrypts tree with the offline data key of filePath after
+// the key services failed with keyErr. Only used while no key service is
+// connected, so a reachable keyservice refusing a key is never overridden.
+func (c *SopsClient) decryptWithGraceKey(tree *sops.Tree, filePath string, keyErr error) ([]string, error) {
+	if c.grace == nil {
+		return nil, keyErr
+	}
+	dataKey, expires, ok := c.grace.load(filePath)
+	if !ok {
+		return nil, keyErr
 	}
+	defer clear(dataKey)
 
-	cur := root
-	for _, k := range keyPath {
-		m, ok := cur.(map[string]any)
-		if !ok {
-			return "", fmt.Errorf("path error at %q", k)
-		}
-		v, ok := m[k]
-		if !ok {
-			return "", fmt.Errorf("key not found: %v", keyPath)
+	cacheLog.Warn("Keyservice unavailable; using offline data key", "file", filePath, "expires", expires.Format(time.RFC3339))
+	tree.Metadata.DataKey = dataKey
+	if _, err := sopscommon.DecryptTree(sopscommon.DecryptTreeOpts{Tree: tree, Cipher: aes.NewCipher()}); err != nil {
+		return nil, fmt.Errorf("offline data key: %w", err)
+	}
+	return []string{graceServiceName}, nil
+}
+
+// ServedBy reports the key services that unwrapped the data key of the cached
+// tree for filePath, or nil if it is not cached
+func (c *SopsClient) ServedBy(filePath string) []string {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	if cached, ok := c.trees[filePath]; ok {
+		return cached.servedBy
+	}
+	return nil
+}
+
+// SetTreeTTL limits how long the decrypted tree of filePath is kept; zero
+// decrypts the file on every cache miss
+func (c *SopsClient) SetTreeTTL(filePath string, ttl time.Duration) {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	if c.treeTTLs == nil {
+		c.treeTTLs = make(map[string]time.Duration)
+	}
+	c.treeTTLs[filePath] = ttl
+}
+
+func (c *SopsClient) treeTTLLocked(filePath string) time.Duration {
+	if ttl, ok := c.treeTTLs[filePath]; ok {
+		return ttl
+	}
+	return decryptedTreeTTL
+}
+
+// PurgeExpiredTrees drops decrypted trees older than their TTL and offline
+// data keys past their grace window
+func (c *SopsClient) PurgeExpiredTrees() {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	for path, cached := range c.trees {
+		if time.Since(cached.timestamp) >= c.treeTTLLocked(path) {
+			c.wipeTreeLocked(path)
+			cacheLog.Debug("Removed expired decrypted tree", "file", path)
 		}
-		cur = v
 	}
 
-	switch v := cur.(type) {
-	case string:
-		return v, nil
-	default:
-		return fmt.Sprintf("%v", v), nil
+	if c.grace != nil {
+		c.grace.purgeExpired()
+	}
+}
+
+// WipeTrees drops every decrypted tree
+func (c *SopsClient) WipeTrees() {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	for path := range c.trees {
+		c.wipeTreeLocked(path)
+	}
+}
+
+// wipeTreeLocked drops the tree of path. Its strings cannot be zeroed and are
+// left to the garbage collector.
+func (c *SopsClient) wipeTreeLocked(path string) {
+	if cached, ok := c.trees[path]; ok {
+		cached.root = nil
+		delete(c.trees, path)
 	}
 }
 
+// IsConnected reports whether any key service can be asked for a data key
+// right now: the local client, or a remote endpoint whose connection is ready
 func (c *SopsClient) IsConnected() bool {
-	return true
+	for _, svc := range c.services {
+		if svc.conn == nil || svc.conn.GetState() == connectivity.Ready {
+			return true
+		}
+	}
+	return false
 }
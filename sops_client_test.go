@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/getsops/sops/v3/keyservice"
+	"google.golang.org/grpc"
+)
+
+// fixtureRecipient is a syntactically valid age recipient; fixtures built with
+// it load fine but can never be decrypted
+const fixtureRecipient = "age15pq2v9dy4jl05spu9v87a9mqtz87uvx6h2svuax2hh76e4zdna4s7ayjan"
+
+// sopsFixture appends the minimal SOPS metadata the YAML store requires to
+// load a file; the values themselves are never decrypted by these tests
+func sopsFixture(body string) string {
+	return body + "sops:\n  age:\n    - recipient: " + fixtureRecipient + "\n      enc: x\n" +
+		"  lastmodified: \"2025-01-01T00:00:00Z\"\n  version: 3.11.0\n"
+}
+
+func TestDecryptKeyUsesTreeCacheForSameFileVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	data := []byte("postgres:\n  admin_pass: ENC[...]\n")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// No keyservices configured: any cache miss would fail to decrypt
+	c := &SopsClient{trees: map[string]*decryptedTree{
+		path: {
+			hash:      sha256.Sum256(data),
+			root:      map[string]any{"postgres": map[string]any{"admin_pass": "hunter2"}},
+			timestamp: time.Now(),
+		},
+	}}
+
+	got, err := c.DecryptKey(context.Background(), path, "", []string{"postgres", "admin_pass"})
+	if err != nil {
+		t.Fatalf("DecryptKey: %v", err)
+	}
+	if got != "hunter2" {
+		t.Errorf("Expected cached value, got %q", got)
+	}
+
+	// Editing the file must invalidate the cached tree
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DecryptKey(context.Background(), path, "", []string{"postgres", "admin_pass"}); err == nil {
+		t.Errorf("Expected decrypt of changed file to miss the cache and fail")
+	}
+	if _, ok := c.trees[path]; ok {
+		t.Errorf("Expected stale tree to be dropped")
+	}
+}
+
+// stalledKeyservice blocks every Decrypt until release is closed
+type stalledKeyservice struct {
+	fakeKeyservice
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (s *stalledKeyservice) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	s.stalled <- struct{}{}
+	<-s.release
+	return s.fakeKeyservice.Decrypt(ctx, req, opts...)
+}
+
+func TestSlowDecryptDoesNotBlockOtherFiles(t *testing.T) {
+	dataKey := make([]byte, 32)
+	slow := writeEncryptedFixture(t, "postgres:\n  pass: s3cret\n", dataKey)
+	cached := writeEncryptedFixture(t, "api:\n  token: t0k3n\n", dataKey)
+	c := &SopsClient{
+		services: []*trackedKeyservice{newTrackedKeyservice("tcp://ks1:5000", &fakeKeyservice{dataKey: dataKey}, nil)},
+		trees:    make(map[string]*decryptedTree),
+	}
+	if _, err := c.DecryptKey(context.Background(), cached, "", []string{"api", "token"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &stalledKeyservice{fakeKeyservice: fakeKeyservice{dataKey: dataKey}, stalled: make(chan struct{}), release: make(chan struct{})}
+	c.services = []*trackedKeyservice{newTrackedKeyservice("tcp://ks1:5000", ks, nil)}
+	done := make(chan error)
+	go func() {
+		_, err := c.DecryptKey(context.Background(), slow, "", []string{"postgres", "pass"})
+		done <- err
+	}()
+	<-ks.stalled
+
+	hit := make(chan string)
+	go func() {
+		got, _ := c.DecryptKey(context.Background(), cached, "", []string{"api", "token"})
+		c.ServedBy(slow)
+		hit <- got
+	}()
+	select {
+	case got := <-hit:
+		if got != "t0k3n" {
+			t.Errorf("Expected the cached value, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cache hit for another file blocked behind a stalled decrypt")
+	}
+
+	close(ks.release)
+	if err := <-done; err != nil {
+		t.Errorf("Stalled decrypt: %v", err)
+	}
+}
+
+func TestPurgeExpiredTrees(t *testing.T) {
+	c := &SopsClient{trees: map[string]*decryptedTree{
+		"fresh.yaml": {timestamp: time.Now()},
+		"stale.yaml": {timestamp: time.Now().Add(-decryptedTreeTTL - time.Second)},
+	}}
+
+	c.PurgeExpiredTrees()
+
+	if _, ok := c.trees["fresh.yaml"]; !ok {
+		t.Errorf("Expected fresh tree to survive purge")
+	}
+	if _, ok := c.trees["stale.yaml"]; ok {
+		t.Errorf("Expected stale tree to be purged")
+	}
+}
+
+func TestGetSecretsStructureFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		format   string
+		content  string
+		expected map[string]interface{}
+	}{
+		{
+			name:    "yaml",
+			file:    "secrets.yaml",
+			content: sopsFixture("postgres:\n  # comment\n  admin_pass: ENC[a]\ntoken: ENC[b]\n"),
+			expected: map[string]interface{}{
+				"postgres": map[string]interface{}{"admin_pass": "ENC[a]"},
+				"token":    "ENC[b]",
+			},
+		},
+		{
+			name:    "json",
+			file:    "secrets.json",
+			content: `{"postgres": {"admin_pass": "ENC[a]"}, "token": "ENC[b]", "sops": {"age": [{"recipient": "` + fixtureRecipient + `", "enc": "x"}], "lastmodified": "2025-01-01T00:00:00Z", "version": "3.11.0"}}`,
+			expected: map[string]interface{}{
+				"postgres": map[string]interface{}{"admin_pass": "ENC[a]"},
+				"token":    "ENC[b]",
+			},
+		},
+		{
+			name:    "dotenv",
+			file:    "app.env",
+			content: "DATABASE_URL=ENC[a]\nAPI_KEY=ENC[b]\nsops_age__list_0__map_recipient=" + fixtureRecipient + "\nsops_age__list_0__map_enc=x\nsops_lastmodified=2025-01-01T00:00:00Z\nsops_version=3.11.0\n",
+			expected: map[string]interface{}{
+				"DATABASE_URL": "ENC[a]",
+				"API_KEY":      "ENC[b]",
+			},
+		},
+		{
+			name:    "ini sections become directories",
+			file:    "app.ini",
+			content: "[database]\npassword = ENC[a]\n\n[sops]\nage__list_0__map_recipient = " + fixtureRecipient + "\nage__list_0__map_enc = x\nlastmodified = 2025-01-01T00:00:00Z\nversion = 3.11.0\n",
+			expected: map[string]interface{}{
+				"database": map[string]interface{}{"password": "ENC[a]"},
+			},
+		},
+		{
+			name:    "binary by explicit format",
+			file:    "keytab.yaml",
+			format:  "binary",
+			content: `{"data": "ENC[a]", "sops": {"age": [{"recipient": "` + fixtureRecipient + `", "enc": "x"}], "lastmodified": "2025-01-01T00:00:00Z", "version": "3.11.0"}}`,
+			expected: map[string]interface{}{
+				"data": "ENC[a]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := (&SopsClient{}).GetSecretsStructure(path, tt.format)
+			if err != nil {
+				t.Fatalf("GetSecretsStructure: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateStoreFormat(t *testing.T) {
+	for _, f := range []string{"", "yaml", "json", "dotenv", "ini", "binary"} {
+		if err := validateStoreFormat(f); err != nil {
+			t.Errorf("validateStoreFormat(%q): %v", f, err)
+		}
+	}
+	if err := validateStoreFormat("toml"); err == nil {
+		t.Errorf("Expected unknown format to be rejected")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+// templatesRoot is the top-level directory exposing rendered templates next to
+// the mounted secrets files
+const templatesRoot = "templates"
+
+// templateName maps a FUSE path under /templates to a template file name; the
+// directory itself maps to ""
+func (fs *SopsFS) templateName(path string) (string, bool) {
+	if fs.templatesDir == "" {
+		return "", false
+	}
+	if path == "/"+templatesRoot {
+		return "", true
+	}
+	return strings.CutPrefix(path, "/"+templatesRoot+"/")
+}
+
+// templateGetattr stats /templates and the templates inside it. A template's
+// size is the length of its rendering, so sizing one decrypts what it uses;
+// those secrets are returned for the audit log.
+func (fs *SopsFS) templateGetattr(name string, stat *fuse.Stat_t) (int, []secretAccess) {
+	if name == "" {
+		stat.Mode = fuse.S_IFDIR | 0555
+		return 0, nil
+	}
+
+	if _, err := fs.templateFile(name); err != nil {
+		return -2, nil // ENOENT
+	}
+
+	content, accessed, err := fs.renderTemplate(name)
+	if err != nil {
+		fsLog.Warn("Cannot render template", "template", name, "error", err)
+		return errno(err), accessed
+	}
+
+	stat.Mode = fuse.S_IFREG | 0444
+	stat.Size = int64(len(content))
+	return 0, accessed
+}
+
+// templateNames lists the templates: regular, non-hidden files directly inside
+// the templates directory
+func (fs *SopsFS) templateNames() ([]string, error) {
+	entries, err := os.ReadDir(fs.templatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// templateFile returns the on-disk path of a template, or ErrNotFound if name
+// is not one that templateNames would list
+func (fs *SopsFS) templateFile(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", ErrNotFound
+	}
+
+	file := filepath.Join(fs.templatesDir, name)
+	fi, err := os.Lstat(file)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", ErrNotFound
+	}
+	return file, nil
+}
+
+// renderTemplate parses the template on every call, so edits show up on the
+// next read, and executes it with a secret function that reads through the
+// same cache as the files under the secrets directories. It returns the
+// secrets the template read, even if it then failed.
+func (fs *SopsFS) renderTemplate(name string) (string, []secretAccess, error) {
+	file, err := fs.templateFile(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var accessed []secretAccess
+	secret := func(ref string) (string, error) { return fs.templateSecret(ref, &accessed) }
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"secret": secret}).
+		Parse(string(text))
+	if err != nil {
+		return "", nil, fmt.Errorf("parse template %s: %w", name, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, nil); err != nil {
+		return "", accessed, fmt.Errorf("render template %s: %w", name, err)
+	}
+	fsLog.Debug("Rendered template", "template", name, "bytes", b.Len())
+	return b.String(), accessed, nil
+}
+
+// templateSecret implements {{ secret "postgres/admin_pass" }}, adding the
+// secret to accessed once it has been read
+func (fs *SopsFS) templateSecret(ref string, accessed *[]secretAccess) (string, error) {
+	path := fs.secretRefPath(ref)
+	var secret string
+	hit, err := fs.withSecret(path, func(b []byte) { secret = string(b) })
+	if err == nil {
+		*accessed = append(*accessed, newSecretAccess(path, hit))
+	}
+	if errors.Is(err, ErrNotFound) {
+		// A missing secret is an error in the template, not a missing file
+		return "", fmt.Errorf("secret %q not found", ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("secret %q: %w", ref, err)
+	}
+	return secret, nil
+}
+
+// secretRefPath resolves a secret reference to a path in the mount. A
+// reference whose first element names a mounted file reads from that file,
+// anything else from the first mounted file.
+func (fs *SopsFS) secretRefPath(ref string) string {
+	ref = strings.Trim(ref, "/")
+	first, _, _ := strings.Cut(ref, "/")
+	if _, ok := fs.files[first]; ok {
+		return "/" + ref
+	}
+	return "/" + fs.fileNames[0] + "/" + ref
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestReadTemplate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.yaml")
+	data := []byte(sopsFixture("postgres:\n  user: ENC[a]\n  pass: ENC[b]\n"))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	templatesDir := filepath.Join(dir, "templates")
+	if err := os.Mkdir(templatesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	templates := map[string]string{
+		"pgpass": `db:5432:*:{{ secret "postgres/user" }}:{{ secret "secrets/postgres/pass" }}` + "\n",
+		"broken": `{{ secret "postgres/missing" }}`,
+		".swp":   "hidden",
+	}
+	for name, text := range templates {
+		if err := os.WriteFile(filepath.Join(templatesDir, name), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &SopsClient{trees: map[string]*decryptedTree{
+		path: {
+			hash:      sha256.Sum256(data),
+			root:      map[string]any{"postgres": map[string]any{"user": "admin", "pass": "s3cret"}},
+			timestamp: time.Now(),
+		},
+	}}
+	fs, err := NewSopsFS(client, []secretsSpec{{name: "secrets", path: path}}, sizeFromEnvelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.templatesDir = templatesDir
+
+	var names []string
+	fs.Readdir("/templates", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		names = append(names, name)
+		return true
+	}, 0, 0)
+	if expected := []string{".", "..", "broken", "pgpass"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	expected := "db:5432:*:admin:s3cret\n"
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/templates/pgpass", &stat, 0); errc != 0 {
+		t.Fatalf("Getattr returned %d", errc)
+	}
+	if stat.Mode&fuse.S_IFMT != fuse.S_IFREG || stat.Size != int64(len(expected)) {
+		t.Errorf("Unexpected stat mode=%o size=%d", stat.Mode, stat.Size)
+	}
+
+	buff := make([]byte, 4096)
+	n := fs.Read("/templates/pgpass", buff, 0, 0)
+	if string(buff[:max(n, 0)]) != expected {
+		t.Errorf("Expected %q, got %q", expected, buff[:max(n, 0)])
+	}
+
+	if errc := fs.Getattr("/templates/broken", &stat, 0); errc != -5 {
+		t.Errorf("Expected EIO for a template referencing a missing secret, got %d", errc)
+	}
+	if errc := fs.Getattr("/templates/.swp", &stat, 0); errc != -2 {
+		t.Errorf("Expected ENOENT for a hidden template, got %d", errc)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// secretTransform converts the content of a secret file for a file name
+// suffix, e.g. cert.b64d serves the base64-decoded bytes of the key cert
+type secretTransform struct {
+	suffix string
+	apply  func(string) (string, error)
+}
+
+// secretTransforms lists the suffix transforms; add an entry to support a new
+// encoding
+var secretTransforms = []secretTransform{
+	{".b64d", decodeBase64},
+	{".b64", encodeBase64},
+	{".hexd", decodeHex},
+	{".hex", encodeHex},
+}
+
+// splitTransformSuffix strips a transform suffix from the last element of a
+// FUSE path, returning the transform it selects or nil if there is none
+func splitTransformSuffix(filePath string) (string, *secretTransform) {
+	ext := path.Ext(filePath)
+	for i, t := range secretTransforms {
+		if ext == t.suffix && len(path.Base(filePath)) > len(ext) {
+			return strings.TrimSuffix(filePath, ext), &secretTransforms[i]
+		}
+	}
+	return filePath, nil
+}
+
+// decodeBase64 accepts padded or unpadded, standard or URL-safe base64, and
+// ignores whitespace so PEM-style wrapped values decode too
+func decodeBase64(s string) (string, error) {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return string(b), nil
+		}
+	}
+	return "", errors.New("invalid base64")
+}
+
+func encodeBase64(s string) (string, error) {
+	return base64.StdEncoding.EncodeToString([]byte(s)), nil
+}
+
+// decodeHex hides the decoder's error, which quotes the offending byte of the
+// secret
+func decodeHex(s string) (string, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return "", errors.New("invalid hex")
+	}
+	return string(b), nil
+}
+
+func encodeHex(s string) (string, error) {
+	return hex.EncodeToString([]byte(s)), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestSecretTransforms(t *testing.T) {
+	tests := []struct {
+		suffix   string
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{".b64d", "aGVsbG8=", "hello", false},
+		{".b64d", "aGVs\nbG8=\n", "hello", false},
+		{".b64d", "aGVsbG8", "hello", false},
+		{".b64d", "_-8", "\xff\xef", false},
+		{".b64d", "not base64!", "", true},
+		{".b64", "hello", "aGVsbG8=", false},
+		{".hex", "\x00\xffA", "00ff41", false},
+		{".hexd", "00ff41\n", "\x00\xffA", false},
+		{".hexd", "xyz", "", true},
+	}
+
+	for _, tt := range tests {
+		_, tr := splitTransformSuffix("/secrets/key" + tt.suffix)
+		if tr == nil {
+			t.Fatalf("No transform for %s", tt.suffix)
+		}
+		got, err := tr.apply(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s(%q): unexpected error %v", tt.suffix, tt.input, err)
+			continue
+		}
+		if !tt.wantErr && got != tt.expected {
+			t.Errorf("%s(%q): expected %q, got %q", tt.suffix, tt.input, tt.expected, got)
+		}
+	}
+
+	if base, tr := splitTransformSuffix("/secrets/.hex"); tr != nil || base != "/secrets/.hex" {
+		t.Errorf("Expected a bare suffix not to select a transform")
+	}
+}
+
+func TestReadTransformedSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	data := []byte(sopsFixture("tls:\n  cert: ENC[a]\n  cert.hex: ENC[b]\n"))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &SopsClient{trees: map[string]*decryptedTree{
+		path: {
+			hash:      sha256.Sum256(data),
+			root:      map[string]any{"tls": map[string]any{"cert": "AAEC/w==", "cert.hex": "literal"}},
+			timestamp: time.Now(),
+		},
+	}}
+	fs, err := NewSopsFS(client, []secretsSpec{{name: "secrets", path: path}}, sizeFromEnvelope, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/secrets/tls/cert.b64d", "\x00\x01\x02\xff"},
+		{"/secrets/tls/cert.hex", "literal"},
+		{"/secrets/tls.json.b64", "ewogICJjZXJ0IjogIkFBRUMvdz09IiwKICAiY2VydC5oZXgiOiAibGl0ZXJhbCIKfQo="},
+	}
+	for _, tt := range tests {
+		var stat fuse.Stat_t
+		if errc := fs.Getattr(tt.path, &stat, 0); errc != 0 {
+			t.Errorf("Getattr(%s) returned %d", tt.path, errc)
+			continue
+		}
+		if stat.Mode&fuse.S_IFMT != fuse.S_IFREG || stat.Size != int64(len(tt.expected)) {
+			t.Errorf("%s: unexpected stat mode=%o size=%d", tt.path, stat.Mode, stat.Size)
+		}
+
+		buff := make([]byte, 4096)
+		n := fs.Read(tt.path, buff, 0, 0)
+		if string(buff[:max(n, 0)]) != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.path, tt.expected, buff[:max(n, 0)])
+		}
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/secrets/tls.b64d", &stat, 0); errc != -2 {
+		t.Errorf("Expected ENOENT transforming a directory, got %d", errc)
+	}
+	if errc := fs.Getattr("/secrets/tls/cert.b64d.hex", &stat, 0); errc != -2 {
+		t.Errorf("Expected ENOENT chaining transforms, got %d", errc)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+)
+
+// isDirNode reports whether a tree node is exposed as a directory: maps by
+// key and sequences by index
+func isDirNode(node interface{}) bool {
+	switch node.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// childNode returns the child of a map by key or of a sequence by its decimal
+// index. Indexes must be canonical ("1", not "01" or "+1") so every element
+// has exactly one path.
+func childNode(node interface{}, key string) (interface{}, bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		v, ok := n[key]
+		return v, ok
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(n) || strconv.Itoa(i) != key {
+			return nil, false
+		}
+		return n[i], true
+	default:
+		return nil, false
+	}
+}
+
+// childEntries calls fn for every child of a directory node, naming sequence
+// elements by index
+func childEntries(node interface{}, fn func(name string, value interface{})) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			fn(k, v)
+		}
+	case []interface{}:
+		for i, v := range n {
+			fn(strconv.Itoa(i), v)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/winfsp/cgofuse/fuse"
+)
+
+func TestChildNode(t *testing.T) {
+	seq := []interface{}{"1.1.1.1", "9.9.9.9"}
+	m := map[string]interface{}{"dns": seq}
+
+	tests := []struct {
+		name     string
+		node     interface{}
+		key      string
+		expected interface{}
+		ok       bool
+	}{
+		{name: "map key", node: m, key: "dns", expected: seq, ok: true},
+		{name: "missing map key", node: m, key: "ntp"},
+		{name: "first index", node: seq, key: "0", expected: "1.1.1.1", ok: true},
+		{name: "last index", node: seq, key: "1", expected: "9.9.9.9", ok: true},
+		{name: "index out of range", node: seq, key: "2"},
+		{name: "negative index", node: seq, key: "-1"},
+		{name: "non-canonical index", node: seq, key: "01"},
+		{name: "signed index", node: seq, key: "+1"},
+		{name: "non-numeric index", node: seq, key: "first"},
+		{name: "leaf has no children", node: "value", key: "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := childNode(tt.node, tt.key)
+			if ok != tt.ok {
+				t.Fatalf("Expected ok=%v, got %v", tt.ok, ok)
+			}
+			if ok && !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestReaddirListsSequenceIndexes(t *testing.T) {
+	sf := newSecretsFile(secretsSpec{name: "secrets", path: "secrets.yaml"})
+	sf.tree = map[string]interface{}{
+		"ssh_keys": []interface{}{"ENC[a]", map[string]interface{}{"key": "unencrypted"}},
+	}
+	fs := &SopsFS{
+		sizeMode:  sizeFromEnvelope,
+		files:     map[string]*secretsFile{"secrets": sf},
+		fileNames: []string{"secrets"},
+	}
+
+	var names []string
+	modes := make(map[string]uint32)
+	errc := fs.Readdir("/secrets/ssh_keys", func(name string, stat *fuse.Stat_t, ofst int64) bool {
+		if stat != nil {
+			names = append(names, name)
+			modes[name] = stat.Mode & fuse.S_IFMT
+		}
+		return true
+	}, 0, 0)
+	if errc != 0 {
+		t.Fatalf("Readdir returned %d", errc)
+	}
+
+	sort.Strings(names)
+	expected := []string{"0", "1", "1.env", "1.json", "1.yaml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected entries %v, got %v", expected, names)
+	}
+	if modes["0"] != fuse.S_IFREG || modes["1"] != fuse.S_IFDIR {
+		t.Errorf("Unexpected modes %v", modes)
+	}
+
+	var stat fuse.Stat_t
+	if errc := fs.Getattr("/secrets/ssh_keys/1/key", &stat, 0); errc != 0 {
+		t.Errorf("Getattr of nested sequence element returned %d", errc)
+	}
+}
+
+func TestDecryptKeyNavigatesSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.yaml")
+	data := []byte(sopsFixture("dns: [ENC[a], ENC[b]]\n"))
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &SopsClient{trees: map[string]*decryptedTree{
+		path: {
+			hash:      sha256.Sum256(data),
+			root:      map[string]any{"dns": []any{"1.1.1.1", "9.9.9.9"}},
+			timestamp: time.Now(),
+		},
+	}}
+
+	got, err := c.DecryptKey(context.Background(), path, "", []string{"dns", "1"})
+	if err != nil {
+		t.Fatalf("DecryptKey: %v", err)
+	}
+	if got != "9.9.9.9" {
+		t.Errorf("Expected 9.9.9.9, got %q", got)
+	}
+}